@@ -34,12 +34,28 @@ func Encrypt(dst io.Writer, recipients ...Recipient) (io.WriteCloser, error) {
 // It behaves like Encrypt, but allows the caller to specify the number of
 // concurrent workers to use.
 func EncryptN(dst io.Writer, concurrent int, recipients ...Recipient) (io.WriteCloser, error) {
-	w, err := realage.Encrypt(dst, recipients...)
+	fileKey, hdr, err := encryptHeader(recipients)
 	if err != nil {
 		return nil, err
 	}
 
-	return stream.NewWriter(w, dst, concurrent), nil
+	nonce, err := writeHeader(dst, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := stream.NewPayloadWriter(streamKey(fileKey, nonce), dst, concurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// abort stops a writer returned by EncryptN without sealing the last chunk,
+// so that what was written to dst is never a complete age file.
+func abort(w io.WriteCloser) {
+	w.(*stream.Writer).Abort()
 }
 
 // Decrypt decrypts a file encrypted to one or more identities.
@@ -56,11 +72,121 @@ func Decrypt(src io.Reader, identities ...Identity) (io.Reader, error) {
 //
 // It behaves like Decrypt, but allows the caller to specify the number of
 // concurrent workers to use.
+//
+// Errors from reading the payload through the returned Reader are
+// *stream.ChunkError values, which tell a truncated file from a modified one.
 func DecryptN(src io.Reader, concurrent int, identities ...Identity) (io.Reader, error) {
-	r, err := realage.Decrypt(src, identities...)
+	fileKey, _, payload, err := decryptHeader(src, identities)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := readNonce(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := stream.NewPayloadReader(streamKey(fileKey, nonce), payload, concurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// DecryptAt decrypts a file of the given size encrypted to one or more
+// identities.
+//
+// It behaves like Decrypt, but instead of a single goroutine reading the
+// ciphertext from src, every worker reads its own chunks with concurrent ReadAt
+// calls. This helps with sources that perform best with many requests in
+// flight, such as network filesystems and fast SSDs.
+//
+// This will use runtime.NumCPU() as the number of concurrent workers.
+func DecryptAt(src io.ReaderAt, size int64, identities ...Identity) (io.Reader, error) {
+	return DecryptAtN(src, size, 0, identities...)
+}
+
+// DecryptAtN decrypts a file of the given size encrypted to one or more
+// identities.
+//
+// It behaves like DecryptAt, but allows the caller to specify the number of
+// concurrent workers to use.
+func DecryptAtN(src io.ReaderAt, size int64, concurrent int, identities ...Identity) (io.Reader, error) {
+	key, payload, err := decryptHeaderAt(src, size, identities)
 	if err != nil {
 		return nil, err
 	}
 
-	return stream.NewReader(r, concurrent), nil
+	r, err := stream.NewPayloadReaderAt(key, payload, payload.Size(), concurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// DecryptReaderAt decrypts a file of the given size encrypted to one or more
+// identities, and provides random access to its plaintext.
+//
+// It returns an io.ReaderAt of the plaintext and its size. Only the chunks
+// covering each ReadAt call are read from src and decrypted, concurrently for
+// reads spanning several chunks. The last chunk is authenticated before
+// returning, so the size can be trusted.
+//
+// This will use runtime.NumCPU() as the number of concurrent workers.
+func DecryptReaderAt(src io.ReaderAt, encryptedSize int64, identities ...Identity) (io.ReaderAt, int64, error) {
+	return DecryptReaderAtN(src, encryptedSize, 0, identities...)
+}
+
+// DecryptReaderAtN decrypts a file of the given size encrypted to one or more
+// identities, and provides random access to its plaintext.
+//
+// It behaves like DecryptReaderAt, but allows the caller to specify the number
+// of concurrent workers to use for each read.
+func DecryptReaderAtN(src io.ReaderAt, encryptedSize int64, concurrent int, identities ...Identity) (io.ReaderAt, int64, error) {
+	key, payload, err := decryptHeaderAt(src, encryptedSize, identities)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r, err := stream.NewReaderAt(key, payload, payload.Size(), concurrent)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return r, r.Size(), nil
+}
+
+// DecryptToWriterAt decrypts a file encrypted to one or more identities into
+// dst, and returns the size of the plaintext.
+//
+// Instead of producing an ordered stream, every worker writes its chunk of
+// plaintext directly to dst at its final position once it has been
+// authenticated. If dst has a Truncate method, like *os.File, it's truncated
+// to the size of the plaintext. On error the content of dst must not be used,
+// as the last chunk has not been authenticated.
+//
+// This will use runtime.NumCPU() as the number of concurrent workers.
+func DecryptToWriterAt(dst io.WriterAt, src io.Reader, identities ...Identity) (int64, error) {
+	return DecryptToWriterAtN(dst, src, 0, identities...)
+}
+
+// DecryptToWriterAtN decrypts a file encrypted to one or more identities into
+// dst.
+//
+// It behaves like DecryptToWriterAt, but allows the caller to specify the
+// number of concurrent workers to use.
+func DecryptToWriterAtN(dst io.WriterAt, src io.Reader, concurrent int, identities ...Identity) (int64, error) {
+	fileKey, _, payload, err := decryptHeader(src, identities)
+	if err != nil {
+		return 0, err
+	}
+
+	nonce, err := readNonce(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	return stream.DecryptPayloadToWriterAt(dst, streamKey(fileKey, nonce), payload, concurrent)
 }
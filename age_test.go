@@ -3,12 +3,19 @@ package age
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"runtime"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	realage "filippo.io/age"
+
+	"github.com/bifrosta/age-concurrent/internal/format"
+	"github.com/bifrosta/age-concurrent/stream"
 )
 
 var (
@@ -262,6 +269,120 @@ func TestEncryptMismatch(t *testing.T) {
 	}
 }
 
+// concurrency tracks how many calls run at once, and the peak.
+type concurrency struct {
+	running int32
+	peak    int32
+}
+
+// enter records the start of a call, and returns a function recording its
+// end.
+func (c *concurrency) enter() func() {
+	n := atomic.AddInt32(&c.running, 1)
+	for {
+		m := atomic.LoadInt32(&c.peak)
+		if n <= m || atomic.CompareAndSwapInt32(&c.peak, m, n) {
+			break
+		}
+	}
+
+	return func() { atomic.AddInt32(&c.running, -1) }
+}
+
+// max returns the largest number of calls that ran at once.
+func (c *concurrency) max() int32 {
+	return atomic.LoadInt32(&c.peak)
+}
+
+// orderRecipient wraps to a stanza recording its position, after a delay. If
+// calls is set, it tracks how many calls run at once.
+type orderRecipient struct {
+	index  int
+	delay  time.Duration
+	labels []string
+	err    error
+	calls  *concurrency
+}
+
+func (r *orderRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	s, _, err := r.WrapWithLabels(fileKey)
+
+	return s, err
+}
+
+func (r *orderRecipient) WrapWithLabels(fileKey []byte) ([]*Stanza, []string, error) {
+	if r.calls != nil {
+		defer r.calls.enter()()
+	}
+
+	time.Sleep(r.delay)
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+
+	return []*Stanza{{Type: "order", Args: []string{fmt.Sprint(r.index)}}}, r.labels, nil
+}
+
+func TestEncryptManyRecipients(t *testing.T) {
+	var calls concurrency
+	recipients := []Recipient{recipient1}
+	for i := 1; i < 100; i++ {
+		recipients = append(recipients, &orderRecipient{index: i, delay: 10 * time.Millisecond, calls: &calls})
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := EncryptN(buf, 2, recipients...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if peak := calls.max(); peak < 2 || peak > maxConcurrentWraps {
+		t.Errorf("expected 2 to %d concurrent wraps, got %d", maxConcurrentWraps, peak)
+	}
+
+	hdr, _, err := format.Parse(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(hdr.Recipients) != 100 || hdr.Recipients[0].Type != "X25519" {
+		t.Fatalf("unexpected stanzas")
+	}
+	for i, s := range hdr.Recipients[1:] {
+		if s.Type != "order" || s.Args[0] != fmt.Sprint(i+1) {
+			t.Fatalf("stanza %d out of order: %v %v", i+1, s.Type, s.Args)
+		}
+	}
+
+	_, err = realage.Decrypt(bytes.NewReader(buf.Bytes()), ident)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The error of the first failing recipient is reported.
+	failing := append([]Recipient{}, recipients...)
+	failing[7] = &orderRecipient{err: errors.New("plugin failed")}
+	failing[3] = &orderRecipient{err: errors.New("plugin failed"), delay: 50 * time.Millisecond}
+
+	_, err = EncryptN(io.Discard, 2, failing...)
+	var recipientErr *RecipientError
+	if !errors.As(err, &recipientErr) || recipientErr.Index != 3 {
+		t.Fatalf("expected an error for recipient 3, got %v", err)
+	}
+
+	// Labels must still match.
+	mismatch := append([]Recipient{}, recipients...)
+	mismatch[50] = &orderRecipient{labels: []string{"postquantum"}}
+
+	_, err = EncryptN(io.Discard, 2, mismatch...)
+	if err == nil || err.Error() != "incompatible recipients" {
+		t.Fatalf("expected incompatible recipients, got %v", err)
+	}
+}
+
 func FuzzDecrypt(f *testing.F) {
 	lengths := []int{
 		0,
@@ -306,6 +427,11 @@ func FuzzDecrypt(f *testing.F) {
 			f.Fatal(err)
 		}
 
+		err = w.Close()
+		if err != nil {
+			f.Fatal(err)
+		}
+
 		f.Add(testFile.Bytes())
 
 		// Verify that the real age can decrypt the file "unfuzzed".
@@ -446,3 +572,163 @@ func TestDecryptBrokenWriter(t *testing.T) {
 		})
 	}
 }
+
+func TestDecryptTruncated(t *testing.T) {
+	encrypted := bytes.NewBuffer(nil)
+
+	w, err := Encrypt(encrypted, recipient1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = w.Write([]byte(genString(3*64*1024 + 100)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Drop the final chunk, leaving a file that ends on a chunk boundary.
+	data := encrypted.Bytes()
+	data = data[:len(data)-(100+16)]
+
+	r, err := Decrypt(bytes.NewReader(data), ident)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	n, err := io.Copy(io.Discard, r)
+	if !errors.Is(err, stream.ErrTruncated) {
+		t.Fatalf("expected truncation error, got %v", err)
+	}
+
+	var chunkErr *stream.ChunkError
+	if !errors.As(err, &chunkErr) || chunkErr.Index != 3 || chunkErr.PlaintextOffset != n {
+		t.Errorf("unexpected error: %+v after %d bytes", chunkErr, n)
+	}
+}
+
+func TestDecryptToWriterAt(t *testing.T) {
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%d", len(c)), func(t *testing.T) {
+			encrypted, err := encryptReader(bytes.NewReader([]byte(c)), recipient1)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			f, err := os.CreateTemp(t.TempDir(), "plain")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer f.Close()
+
+			// Leftovers from a previous, longer file must be truncated.
+			_, err = f.Write(make([]byte, len(c)+100))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			n, err := DecryptToWriterAtN(f, encrypted, 3, ident)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(c) != int(n) {
+				t.Fatalf("unexpected length: %d", n)
+			}
+
+			out, err := os.ReadFile(f.Name())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(out, []byte(c)) {
+				t.Fatalf("unexpected output")
+			}
+		})
+	}
+}
+
+func TestDecryptAt(t *testing.T) {
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%d", len(c)), func(t *testing.T) {
+			encrypted, err := encryptReader(bytes.NewReader([]byte(c)), recipient1)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			data := encrypted.(*bytes.Buffer).Bytes()
+
+			r, err := DecryptAtN(bytes.NewReader(data), int64(len(data)), 3, ident)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			out := bytes.NewBuffer(nil)
+
+			_, err = io.Copy(out, r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(out.Bytes(), []byte(c)) {
+				t.Fatalf("unexpected output")
+			}
+
+			// Trailing data must still be detected.
+			data = append(data, 0)
+
+			r, err = DecryptAtN(bytes.NewReader(data), int64(len(data)), 3, ident)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			_, err = io.Copy(io.Discard, r)
+			if err == nil {
+				t.Fatalf("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestDecryptReaderAt(t *testing.T) {
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%d", len(c)), func(t *testing.T) {
+			encrypted, err := encryptReader(bytes.NewReader([]byte(c)), recipient1)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			data := encrypted.(*bytes.Buffer).Bytes()
+
+			r, size, err := DecryptReaderAtN(bytes.NewReader(data), int64(len(data)), 3, ident)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if size != int64(len(c)) {
+				t.Fatalf("unexpected size: %d", size)
+			}
+
+			// Read the second half first, then the first half.
+			out := make([]byte, len(c))
+
+			_, err = r.ReadAt(out[len(c)/2:], int64(len(c)/2))
+			if err != nil && err != io.EOF {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			_, err = r.ReadAt(out[:len(c)/2], 0)
+			if err != nil && err != io.EOF {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(out, []byte(c)) {
+				t.Fatalf("unexpected output")
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+// Package agearchive packs many files into a single age encrypted file, with
+// an index allowing to extract any of them without decrypting the others.
+//
+// The plaintext of an archive is the content of its members, one after the
+// other, followed by the index of their names, offsets, sizes and metadata,
+// and a 16 bytes trailer holding the offset of the index and a magic string.
+// The whole archive, including the index, is a regular age file.
+//
+// Reading a member only decrypts the chunks covering it, and the ones holding
+// the index when the archive is opened:
+//
+//	r, err := agearchive.NewReader(f, size, 0, identity)
+//	if err != nil {
+//		return err
+//	}
+//	member, err := r.Open("path/to/file")
+package agearchive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	age "github.com/bifrosta/age-concurrent"
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+const (
+	magic       = "agearc01"
+	trailerSize = 8 + len(magic)
+)
+
+var errInvalidIndex = errors.New("agearchive: invalid index")
+
+// Header describes a member of an archive.
+type Header struct {
+	// Name is a slash-separated path, as accepted by fs.ValidPath.
+	Name string
+
+	Mode    fs.FileMode
+	ModTime time.Time
+
+	// Offset and Size locate the content of the member in the plaintext of
+	// the archive. They are set by the Writer.
+	Offset int64
+	Size   int64
+}
+
+// Writer writes an archive.
+type Writer struct {
+	w       io.WriteCloser
+	offset  int64
+	current *Header
+	headers []*Header
+	names   map[string]bool
+	err     error
+}
+
+// NewWriter returns a Writer encrypting an archive to one or more recipients
+// into dst, using age.EncryptN with concurrent workers.
+func NewWriter(dst io.Writer, concurrent int, recipients ...age.Recipient) (*Writer, error) {
+	w, err := age.EncryptN(dst, concurrent, recipients...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:     w,
+		names: make(map[string]bool),
+	}, nil
+}
+
+// Create adds a member of the given name, and returns a Writer for its
+// content. It's like CreateHeader with only the name set.
+func (w *Writer) Create(name string) (io.Writer, error) {
+	return w.CreateHeader(&Header{Name: name})
+}
+
+// CreateHeader adds a member described by h, and returns a Writer for its
+// content, valid until the next call to Create, CreateHeader or Close. Names
+// must be unique. The Writer takes ownership of h, and sets its Offset and
+// Size.
+func (w *Writer) CreateHeader(h *Header) (io.Writer, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	if !fs.ValidPath(h.Name) || h.Name == "." {
+		return nil, fmt.Errorf("agearchive: invalid name %q", h.Name)
+	}
+	if w.names[h.Name] {
+		return nil, fmt.Errorf("agearchive: duplicate name %q", h.Name)
+	}
+	w.names[h.Name] = true
+
+	w.finish()
+
+	h.Offset = w.offset
+	h.Size = 0
+	w.current = h
+	w.headers = append(w.headers, h)
+
+	return memberWriter{w: w, h: h}, nil
+}
+
+// finish sets the size of the current member.
+func (w *Writer) finish() {
+	if w.current != nil {
+		w.current.Size = w.offset - w.current.Offset
+		w.current = nil
+	}
+}
+
+func (w *Writer) write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n, err := w.w.Write(p)
+	w.offset += int64(n)
+	if err != nil {
+		w.err = err
+	}
+
+	return n, err
+}
+
+type memberWriter struct {
+	w *Writer
+	h *Header
+}
+
+func (m memberWriter) Write(p []byte) (int, error) {
+	if m.w.current != m.h {
+		return 0, errors.New("agearchive: write to a closed member")
+	}
+
+	return m.w.write(p)
+}
+
+// Close writes the index and finishes encrypting the archive. It doesn't close
+// the underlying writer.
+//
+// After a write error, Close stops encrypting without sealing the last chunk,
+// so that the failed archive never authenticates as complete.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		w.abort()
+
+		return w.err
+	}
+
+	w.finish()
+
+	index := marshalIndex(w.headers)
+	trailer := make([]byte, trailerSize)
+	binary.BigEndian.PutUint64(trailer, uint64(w.offset))
+	copy(trailer[8:], magic)
+
+	_, err := w.write(append(index, trailer...))
+	if err != nil {
+		w.abort()
+
+		return err
+	}
+
+	w.err = errors.New("agearchive: archive already closed")
+
+	return w.w.Close()
+}
+
+// abort stops the workers of the age writer, and does nothing once it's
+// closed.
+func (w *Writer) abort() {
+	w.w.(*stream.Writer).Abort()
+}
+
+func marshalIndex(headers []*Header) []byte {
+	var buf []byte
+
+	buf = binary.AppendUvarint(buf, uint64(len(headers)))
+	for _, h := range headers {
+		var modTime int64
+		if !h.ModTime.IsZero() {
+			modTime = h.ModTime.UnixNano()
+		}
+
+		buf = binary.AppendUvarint(buf, uint64(len(h.Name)))
+		buf = append(buf, h.Name...)
+		buf = binary.AppendUvarint(buf, uint64(h.Mode))
+		buf = binary.AppendVarint(buf, modTime)
+		buf = binary.AppendUvarint(buf, uint64(h.Offset))
+		buf = binary.AppendUvarint(buf, uint64(h.Size))
+	}
+
+	return buf
+}
+
+func unmarshalIndex(index []byte, dataSize int64) ([]*Header, error) {
+	r := bytes.NewReader(index)
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(len(index)) {
+		return nil, errInvalidIndex
+	}
+
+	headers := make([]*Header, 0, count)
+	for i := uint64(0); i < count; i++ {
+		nameLen, err := binary.ReadUvarint(r)
+		if err != nil || nameLen > uint64(r.Len()) {
+			return nil, errInvalidIndex
+		}
+		name := make([]byte, nameLen)
+		_, _ = r.Read(name)
+
+		mode, err1 := binary.ReadUvarint(r)
+		modTime, err2 := binary.ReadVarint(r)
+		offset, err3 := binary.ReadUvarint(r)
+		size, err4 := binary.ReadUvarint(r)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			return nil, errInvalidIndex
+		}
+		if offset > uint64(dataSize) || size > uint64(dataSize)-offset || !fs.ValidPath(string(name)) {
+			return nil, errInvalidIndex
+		}
+
+		h := &Header{
+			Name:   string(name),
+			Mode:   fs.FileMode(mode),
+			Offset: int64(offset),
+			Size:   int64(size),
+		}
+		if modTime != 0 {
+			h.ModTime = time.Unix(0, modTime)
+		}
+		headers = append(headers, h)
+	}
+
+	if r.Len() != 0 {
+		return nil, errInvalidIndex
+	}
+
+	return headers, nil
+}
+
+// Reader reads an archive with random access.
+type Reader struct {
+	// Members are the members of the archive, in the order they were added.
+	Members []*Header
+
+	r     io.ReaderAt
+	names map[string]*Header
+}
+
+// NewReader opens the archive of the given size read from src, decrypting it
+// with one or more identities using age.DecryptReaderAtN with concurrent
+// workers. Only the header and the chunks holding the index are decrypted.
+func NewReader(src io.ReaderAt, size int64, concurrent int, identities ...age.Identity) (*Reader, error) {
+	r, plaintextSize, err := age.DecryptReaderAtN(src, size, concurrent, identities...)
+	if err != nil {
+		return nil, err
+	}
+
+	if plaintextSize < int64(trailerSize) {
+		return nil, errors.New("agearchive: not an archive")
+	}
+
+	trailer := make([]byte, trailerSize)
+	_, err = r.ReadAt(trailer, plaintextSize-int64(trailerSize))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(trailer[8:]) != magic {
+		return nil, errors.New("agearchive: not an archive")
+	}
+
+	indexOffset := int64(binary.BigEndian.Uint64(trailer))
+	if indexOffset < 0 || indexOffset > plaintextSize-int64(trailerSize) {
+		return nil, errInvalidIndex
+	}
+
+	index := make([]byte, plaintextSize-int64(trailerSize)-indexOffset)
+	_, err = r.ReadAt(index, indexOffset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	headers, err := unmarshalIndex(index, indexOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]*Header, len(headers))
+	for _, h := range headers {
+		if names[h.Name] != nil {
+			return nil, errInvalidIndex
+		}
+		names[h.Name] = h
+	}
+
+	return &Reader{
+		Members: headers,
+		r:       r,
+		names:   names,
+	}, nil
+}
+
+// Header returns the header of the member name.
+func (r *Reader) Header(name string) (*Header, bool) {
+	h, ok := r.names[name]
+
+	return h, ok
+}
+
+// Open returns the content of the member name. Reading it only decrypts the
+// chunks covering it, and fails with a *stream.ChunkError if one of them
+// doesn't authenticate.
+func (r *Reader) Open(name string) (*io.SectionReader, error) {
+	h, ok := r.names[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return r.OpenHeader(h), nil
+}
+
+// OpenHeader returns the content of the member described by h, one of the
+// Members of r.
+func (r *Reader) OpenHeader(h *Header) *io.SectionReader {
+	return io.NewSectionReader(r.r, h.Offset, h.Size)
+}
@@ -0,0 +1,227 @@
+package agearchive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	age "github.com/bifrosta/age-concurrent"
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+var testIdentity, _ = age.GenerateX25519Identity()
+
+func genBytes(length, seed int) []byte {
+	buf := make([]byte, length)
+
+	for i := 0; i < length; i++ {
+		buf[i] = byte(i*7 + seed)
+	}
+
+	return buf
+}
+
+// countingReaderAt counts the bytes read from it.
+type countingReaderAt struct {
+	r    io.ReaderAt
+	read int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	atomic.AddInt64(&c.read, int64(n))
+
+	return n, err
+}
+
+func TestArchive(t *testing.T) {
+	sizes := []int{0, 1, 100, stream.ChunkSize - 1, 3*stream.ChunkSize + 5, 10, 20 * stream.ChunkSize, 7}
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+
+	buf := &bytes.Buffer{}
+
+	w, err := NewWriter(buf, 4, testIdentity.Recipient())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, size := range sizes {
+		mw, err := w.CreateHeader(&Header{Name: fmt.Sprintf("dir/%d", i), Mode: 0o640, ModTime: modTime})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		_, err = mw.Write(genBytes(size, i))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	_, err = w.Create("dir/0")
+	if err == nil {
+		t.Fatalf("expected an error for a duplicate name")
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	src := &countingReaderAt{r: bytes.NewReader(buf.Bytes())}
+
+	r, err := NewReader(src, int64(buf.Len()), 4, testIdentity)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(r.Members) != len(sizes) {
+		t.Fatalf("expected %d members, got %d", len(sizes), len(r.Members))
+	}
+
+	for i, size := range sizes {
+		h := r.Members[i]
+		if h.Name != fmt.Sprintf("dir/%d", i) || h.Size != int64(size) || h.Mode != 0o640 || !h.ModTime.Equal(modTime) {
+			t.Fatalf("unexpected header %+v", h)
+		}
+
+		member, err := r.Open(h.Name)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		data, err := io.ReadAll(member)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !bytes.Equal(data, genBytes(size, i)) {
+			t.Fatalf("member %d: plaintext mismatch", i)
+		}
+	}
+
+	// A small member after a large one only needs its own chunk.
+	src.read = 0
+
+	data, err := io.ReadAll(r.OpenHeader(r.Members[7]))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(data, genBytes(7, 7)) {
+		t.Fatalf("plaintext mismatch")
+	}
+	if src.read > 2*(stream.ChunkSize+16) {
+		t.Fatalf("read %d bytes of ciphertext for a 7 bytes member", src.read)
+	}
+
+	_, err = r.Open("missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestArchiveErrors(t *testing.T) {
+	// A regular age file isn't an archive.
+	buf := &bytes.Buffer{}
+
+	w, err := age.Encrypt(buf, testIdentity.Recipient())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w.Write(genBytes(1000, 0))
+	w.Close()
+
+	_, err = NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), 0, testIdentity)
+	if err == nil {
+		t.Fatalf("expected an error for a regular age file")
+	}
+
+	// A corrupted member fails to read, without affecting the others.
+	buf.Reset()
+
+	aw, err := NewWriter(buf, 0, testIdentity.Recipient())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"a", "b"} {
+		mw, _ := aw.Create(name)
+		mw.Write(genBytes(2*stream.ChunkSize, 0))
+	}
+
+	for _, name := range []string{"", ".", "../a", "/a"} {
+		_, err := aw.Create(name)
+		if err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+	aw.Close()
+
+	data := buf.Bytes()
+	// Flip a byte in the first chunk, after the header.
+	data[1000] ^= 0x01
+
+	r, err := NewReader(bytes.NewReader(data), int64(len(data)), 0, testIdentity)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	member, _ := r.Open("a")
+	_, err = io.ReadAll(member)
+	var chunkErr *stream.ChunkError
+	if !errors.As(err, &chunkErr) {
+		t.Fatalf("expected a *stream.ChunkError, got %v", err)
+	}
+
+	member, _ = r.Open("b")
+	_, err = io.ReadAll(member)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+type failingWriter struct {
+	after int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.after {
+		return 0, errors.New("write error")
+	}
+	f.after -= len(p)
+
+	return len(p), nil
+}
+
+func TestArchiveWriteError(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	aw, err := NewWriter(&failingWriter{after: 1000}, 2, testIdentity.Recipient())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mw, _ := aw.Create("a")
+	for i := 0; i < 100 && err == nil; i++ {
+		_, err = mw.Write(genBytes(stream.ChunkSize, i))
+	}
+	if err == nil {
+		t.Fatalf("expected a write error")
+	}
+
+	if err := aw.Close(); err == nil {
+		t.Fatalf("expected the write error from Close")
+	}
+
+	// The workers are stopped.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked: %d running, expected at most %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,27 @@
+// Package agehttp connects concurrent age encryption and decryption with
+// net/http.
+//
+// A RangeReader reads an age file from an HTTP server or object store with
+// parallel Range requests, so the workers of age.DecryptAtN fetch and decrypt
+// their chunks concurrently without downloading the file first:
+//
+//	src, err := agehttp.NewRangeReader(ctx, url, nil)
+//	if err != nil {
+//		return err
+//	}
+//	r, err := age.DecryptAtN(src, src.Size(), 16, identity)
+//
+// age.DecryptReaderAt provides random access to the plaintext the same way.
+//
+// A Handler serves decrypted age files, answering Range requests by
+// decrypting only the chunks they cover:
+//
+//	http.Handle("/files/", http.StripPrefix("/files", agehttp.NewFSHandler(os.DirFS(dir), identity)))
+//
+// A Transport encrypts request bodies and decrypts response bodies on the fly:
+//
+//	client := &http.Client{Transport: &agehttp.Transport{
+//		Recipients: []age.Recipient{recipient},
+//		Identities: []age.Identity{identity},
+//	}}
+package agehttp
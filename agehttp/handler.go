@@ -0,0 +1,287 @@
+package agehttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	age "github.com/bifrosta/age-concurrent"
+	"github.com/bifrosta/age-concurrent/internal/readerat"
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+// Object is an age encrypted file served by a Handler.
+type Object struct {
+	// Content is the encrypted file. If it implements io.Closer, it's closed
+	// once the response is done.
+	Content io.ReaderAt
+
+	// Size is the size of the encrypted file.
+	Size int64
+
+	// Name is used to detect the content type from its extension.
+	Name string
+
+	// ModTime is used for conditional requests if not zero.
+	ModTime time.Time
+
+	// ETag is used for conditional requests if not empty. It must be a quoted
+	// entity tag, and identify the plaintext.
+	ETag string
+}
+
+// LookupFunc returns the encrypted object for a request. Errors wrapping
+// fs.ErrNotExist and fs.ErrPermission result in 404 and 403 responses.
+type LookupFunc func(r *http.Request) (*Object, error)
+
+// Handler serves decrypted age files.
+//
+// The Content-Length is derived from the size of the encrypted file, and Range
+// and conditional requests are supported by decrypting only the chunks covering
+// the requested ranges.
+//
+// If a chunk fails to authenticate before any of the body is sent, the client
+// gets a 500 response. Otherwise the response is aborted, so a partial body is
+// never mistaken for a complete one.
+type Handler struct {
+	Lookup     LookupFunc
+	Identities []age.Identity
+
+	// Concurrent is the number of workers decrypting each request. If less
+	// than one, runtime.NumCPU() is used. Single range responses are read
+	// Concurrent chunks at a time, so each request buffers that much
+	// plaintext.
+	Concurrent int
+
+	// ErrorLog, if not nil, is called with errors that aren't sent to the
+	// client in full.
+	ErrorLog func(r *http.Request, err error)
+}
+
+// NewHandler returns a Handler serving the objects returned by lookup,
+// decrypted with identities.
+func NewHandler(lookup LookupFunc, identities ...age.Identity) *Handler {
+	return &Handler{
+		Lookup:     lookup,
+		Identities: identities,
+	}
+}
+
+// NewFSHandler returns a Handler serving the files of fsys decrypted with
+// identities. A request for /dir/name is served from dir/name.age.
+//
+// Files must implement io.ReaderAt or io.Seeker, as those opened from
+// os.DirFS, embed.FS and fstest.MapFS do.
+func NewFSHandler(fsys fs.FS, identities ...age.Identity) *Handler {
+	return NewHandler(FSLookup(fsys), identities...)
+}
+
+// FSLookup returns a LookupFunc opening name.age in fsys for a request of
+// /name.
+func FSLookup(fsys fs.FS) LookupFunc {
+	return func(r *http.Request) (*Object, error) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if name == "" {
+			return nil, fs.ErrNotExist
+		}
+
+		f, err := fsys.Open(name + ".age")
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := f.Stat()
+		if err == nil && info.IsDir() {
+			err = fs.ErrNotExist
+		}
+		if err != nil {
+			f.Close()
+
+			return nil, err
+		}
+
+		content, err := readerat.FromFile(f)
+		if err != nil {
+			f.Close()
+
+			return nil, err
+		}
+
+		return &Object{
+			Content: content,
+			Size:    info.Size(),
+			Name:    name,
+			ModTime: info.ModTime(),
+		}, nil
+	}
+}
+
+func (h *Handler) logError(r *http.Request, err error) {
+	if h.ErrorLog != nil {
+		h.ErrorLog(r, err)
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	obj, err := h.Lookup(r)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "404 page not found", http.StatusNotFound)
+
+		return
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+
+		return
+	case err != nil:
+		h.logError(r, err)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+
+		return
+	}
+
+	if c, ok := obj.Content.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	plaintext, size, err := age.DecryptReaderAtN(obj.Content, obj.Size, h.Concurrent, h.Identities...)
+	if err != nil {
+		h.logError(r, fmt.Errorf("failed to decrypt %s: %w", obj.Name, err))
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+
+		return
+	}
+
+	if obj.ETag != "" {
+		w.Header().Set("ETag", obj.ETag)
+	}
+
+	content := &recordingReader{r: io.NewSectionReader(plaintext, 0, size)}
+	concurrent := h.Concurrent
+	if concurrent < 1 {
+		concurrent = runtime.NumCPU()
+	}
+	dw := &deferredWriter{ResponseWriter: w, bufSize: concurrent * stream.ChunkSize}
+
+	http.ServeContent(dw, r, obj.Name, obj.ModTime, content)
+
+	err = content.error()
+	if err == nil {
+		dw.commit()
+
+		return
+	}
+
+	h.logError(r, fmt.Errorf("failed to decrypt %s: %w", obj.Name, err))
+
+	if dw.committed {
+		// Part of the body has been sent, make sure the client notices it's
+		// incomplete.
+		panic(http.ErrAbortHandler)
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Del("Content-Range")
+	w.Header().Del("ETag")
+	w.Header().Del("Last-Modified")
+	http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+}
+
+// recordingReader records the first read error other than io.EOF. Reads can
+// come from another goroutine for multi-range responses.
+type recordingReader struct {
+	r *io.SectionReader
+
+	mu  sync.Mutex
+	err error
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.mu.Lock()
+		if r.err == nil {
+			r.err = err
+		}
+		r.mu.Unlock()
+	}
+
+	return n, err
+}
+
+func (r *recordingReader) Seek(offset int64, whence int) (int64, error) {
+	return r.r.Seek(offset, whence)
+}
+
+func (r *recordingReader) error() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+// deferredWriter holds back the status code until the first write of the
+// body, so the response can still be replaced by an error.
+//
+// It also reads the body bufSize bytes at a time: http.ServeContent copies
+// with a 32 KiB buffer otherwise, and every read would only decrypt one or two
+// chunks.
+type deferredWriter struct {
+	http.ResponseWriter
+
+	code      int
+	committed bool
+	bufSize   int
+}
+
+func (d *deferredWriter) WriteHeader(code int) {
+	if d.code == 0 {
+		d.code = code
+	}
+}
+
+func (d *deferredWriter) commit() {
+	if d.committed {
+		return
+	}
+	d.committed = true
+
+	if d.code != 0 {
+		d.ResponseWriter.WriteHeader(d.code)
+	}
+}
+
+func (d *deferredWriter) Write(p []byte) (int, error) {
+	d.commit()
+
+	return d.ResponseWriter.Write(p)
+}
+
+func (d *deferredWriter) ReadFrom(src io.Reader) (int64, error) {
+	buf := make([]byte, d.bufSize)
+
+	var written int64
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			m, werr := d.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
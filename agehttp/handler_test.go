@@ -0,0 +1,231 @@
+package agehttp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+func TestHandler(t *testing.T) {
+	plaintext := genBytes(5*stream.ChunkSize + 1234)
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	fsys := fstest.MapFS{
+		"dir/file.txt.age": &fstest.MapFile{Data: encrypt(t, plaintext), ModTime: modTime},
+		"empty.txt.age":    &fstest.MapFile{Data: encrypt(t, nil), ModTime: modTime},
+	}
+
+	srv := httptest.NewServer(NewFSHandler(fsys, testIdentity))
+	defer srv.Close()
+
+	get := func(path string, header http.Header) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return resp, body
+	}
+
+	resp, body := get("/dir/file.txt", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if resp.ContentLength != int64(len(plaintext)) {
+		t.Errorf("expected Content-Length %d, got %d", len(plaintext), resp.ContentLength)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	if !bytes.Equal(body, plaintext) {
+		t.Fatalf("plaintext mismatch")
+	}
+
+	resp, body = get("/dir/file.txt", http.Header{"Range": {"bytes=70000-200000"}})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected status 206, got %d", resp.StatusCode)
+	}
+	if !bytes.Equal(body, plaintext[70000:200001]) {
+		t.Fatalf("plaintext mismatch")
+	}
+
+	lastModified := modTime.Format(http.TimeFormat)
+
+	resp, body = get("/dir/file.txt", http.Header{"Range": {"bytes=-10"}, "If-Range": {lastModified}})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected status 206, got %d", resp.StatusCode)
+	}
+	if !bytes.Equal(body, plaintext[len(plaintext)-10:]) {
+		t.Fatalf("plaintext mismatch")
+	}
+
+	stale := modTime.Add(-time.Hour).Format(http.TimeFormat)
+
+	resp, body = get("/dir/file.txt", http.Header{"Range": {"bytes=-10"}, "If-Range": {stale}})
+	if resp.StatusCode != http.StatusOK || len(body) != len(plaintext) {
+		t.Fatalf("expected the full content, got status %d and %d bytes", resp.StatusCode, len(body))
+	}
+
+	resp, _ = get("/dir/file.txt", http.Header{"If-Modified-Since": {lastModified}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected status 304, got %d", resp.StatusCode)
+	}
+
+	resp, body = get("/empty.txt", nil)
+	if resp.StatusCode != http.StatusOK || len(body) != 0 {
+		t.Fatalf("expected an empty body, got status %d and %d bytes", resp.StatusCode, len(body))
+	}
+
+	for _, path := range []string{"/", "/dir", "/missing", "/dir/file.txt.age", "/../dir/file.txt.age"} {
+		resp, _ = get(path, nil)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	plaintext := genBytes(5*stream.ChunkSize + 1234)
+
+	encrypted := encrypt(t, plaintext)
+	tampered := append([]byte(nil), encrypted...)
+	// Flip a byte in the fourth chunk, counting from the end of the file.
+	tampered[len(tampered)-2*stream.ChunkSize] ^= 0x01
+
+	var mu sync.Mutex
+	var logged []error
+
+	h := NewHandler(func(r *http.Request) (*Object, error) {
+		switch r.URL.Path {
+		case "/tampered":
+			return &Object{Content: bytes.NewReader(tampered), Size: int64(len(tampered)), Name: "tampered"}, nil
+		case "/forbidden":
+			return nil, fs.ErrPermission
+		case "/broken":
+			return nil, errors.New("broken")
+		}
+
+		return nil, fs.ErrNotExist
+	}, testIdentity)
+	h.ErrorLog = func(r *http.Request, err error) {
+		mu.Lock()
+		logged = append(logged, err)
+		mu.Unlock()
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	for path, status := range map[string]int{"/forbidden": 403, "/broken": 500, "/missing": 404} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != status {
+			t.Errorf("%s: expected status %d, got %d", path, status, resp.StatusCode)
+		}
+	}
+
+	// Failing before any of the body is sent results in a clean error.
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/tampered", nil)
+	req.Header.Set("Range", "bytes=200000-")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", resp.StatusCode)
+	}
+
+	mu.Lock()
+	var chunkErr *stream.ChunkError
+	ok := len(logged) > 0 && errors.As(logged[len(logged)-1], &chunkErr)
+	mu.Unlock()
+
+	if !ok {
+		t.Fatalf("expected a logged *stream.ChunkError")
+	}
+
+	// Failing later aborts the response.
+	resp, err = http.Get(srv.URL + "/tampered")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Fatalf("expected an error reading the body")
+	}
+	if !bytes.Equal(body, plaintext[:len(body)]) {
+		t.Fatalf("plaintext mismatch")
+	}
+}
+
+// maxReader records the largest read from it.
+type maxReader struct {
+	r   io.Reader
+	max int
+}
+
+func (m *maxReader) Read(p []byte) (int, error) {
+	if len(p) > m.max {
+		m.max = len(p)
+	}
+
+	return m.r.Read(p)
+}
+
+func TestDeferredWriterReadFrom(t *testing.T) {
+	plaintext := genBytes(10*stream.ChunkSize + 1234)
+
+	rec := httptest.NewRecorder()
+	dw := &deferredWriter{ResponseWriter: rec, bufSize: 4 * stream.ChunkSize}
+	dw.WriteHeader(http.StatusPartialContent)
+
+	// http.ServeContent copies the body with io.CopyN.
+	src := &maxReader{r: bytes.NewReader(plaintext)}
+	n, err := io.CopyN(dw, src, int64(len(plaintext)))
+	if err != nil || n != int64(len(plaintext)) {
+		t.Fatalf("unexpected copy of %d bytes: %v", n, err)
+	}
+
+	if src.max != 4*stream.ChunkSize {
+		t.Errorf("expected reads of %d bytes, got %d", 4*stream.ChunkSize, src.max)
+	}
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), plaintext) {
+		t.Errorf("unexpected response %d of %d bytes", rec.Code, rec.Body.Len())
+	}
+}
@@ -0,0 +1,333 @@
+package agehttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultBlockSize = 1024 * 1024
+	defaultParallel  = 8
+)
+
+// RangeOptions configures a RangeReader. A nil *RangeOptions uses the
+// defaults.
+type RangeOptions struct {
+	// Client is used for all requests, http.DefaultClient if nil.
+	Client *http.Client
+
+	// Header is added to every request, for example for authorization.
+	Header http.Header
+
+	// BlockSize is the size of the ranges requested from the server, 1 MiB if
+	// zero. Reads are coalesced into requests for the blocks covering them.
+	BlockSize int64
+
+	// Parallel is the maximum number of requests in flight, 8 if zero.
+	Parallel int
+
+	// CacheBlocks is the number of fetched blocks to keep for later reads,
+	// twice Parallel if zero.
+	CacheBlocks int
+}
+
+type block struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// RangeReader is an io.ReaderAt over an HTTP resource, read with Range
+// requests.
+//
+// Reads are served from fixed-size blocks. Concurrent reads of the same block
+// share a single request, and reads spanning several blocks fetch them in
+// parallel.
+//
+// If the server returns a strong ETag, every request is conditional on it, so
+// a resource replaced while it is being read fails with an error instead of
+// mixing two versions.
+type RangeReader struct {
+	ctx       context.Context
+	client    *http.Client
+	url       string
+	header    http.Header
+	blockSize int64
+	cacheSize int
+
+	size int64
+	etag string
+
+	sem chan struct{}
+
+	mu     sync.Mutex
+	blocks map[int64]*block
+	cached []int64
+}
+
+// NewRangeReader returns a RangeReader for url. It fetches the first block to
+// learn the size of the resource, and fails if the server doesn't support
+// Range requests.
+//
+// ctx is used for all requests made by the RangeReader.
+func NewRangeReader(ctx context.Context, url string, opts *RangeOptions) (*RangeReader, error) {
+	if opts == nil {
+		opts = &RangeOptions{}
+	}
+
+	r := &RangeReader{
+		ctx:       ctx,
+		client:    opts.Client,
+		url:       url,
+		header:    opts.Header,
+		blockSize: opts.BlockSize,
+		cacheSize: opts.CacheBlocks,
+		blocks:    make(map[int64]*block),
+	}
+
+	if r.client == nil {
+		r.client = http.DefaultClient
+	}
+	if r.blockSize < 1 {
+		r.blockSize = defaultBlockSize
+	}
+
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = defaultParallel
+	}
+	r.sem = make(chan struct{}, parallel)
+
+	if r.cacheSize < 1 {
+		r.cacheSize = 2 * parallel
+	}
+
+	b := &block{done: make(chan struct{})}
+
+	r.size = -1
+	b.data, b.err = r.fetch(0)
+	close(b.done)
+
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	r.blocks[0] = b
+	r.cached = append(r.cached, 0)
+
+	return r, nil
+}
+
+// Size returns the size of the resource.
+func (r *RangeReader) Size() int64 {
+	return r.size
+}
+
+// fetch requests block index. The first request, made while the size is
+// still unknown, also records the size and ETag of the resource.
+func (r *RangeReader) fetch(index int64) ([]byte, error) {
+	start := index * r.blockSize
+	end := start + r.blockSize - 1
+	if r.size >= 0 && end >= r.size {
+		end = r.size - 1
+	}
+
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if r.etag != "" {
+		req.Header.Set("If-Match", r.etag)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// An empty resource has no satisfiable range.
+		if r.size < 0 && resp.Header.Get("Content-Range") == "bytes */0" {
+			r.size = 0
+
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("agehttp: range %d-%d not satisfiable", start, end)
+	case http.StatusOK:
+		return nil, errors.New("agehttp: server does not support range requests")
+	case http.StatusPreconditionFailed:
+		return nil, errors.New("agehttp: resource changed while reading")
+	default:
+		return nil, fmt.Errorf("agehttp: unexpected status: %s", resp.Status)
+	}
+
+	first, last, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, err
+	}
+
+	if r.size < 0 {
+		r.size = total
+		if etag := resp.Header.Get("ETag"); !strings.HasPrefix(etag, "W/") {
+			r.etag = etag
+		}
+		if end >= total {
+			end = total - 1
+		}
+	}
+
+	if first != start || last != end || total != r.size {
+		return nil, fmt.Errorf("agehttp: unexpected Content-Range: %q", resp.Header.Get("Content-Range"))
+	}
+
+	data := make([]byte, end-start+1)
+
+	_, err = io.ReadFull(resp.Body, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// parseContentRange parses a "bytes first-last/total" header.
+func parseContentRange(s string) (int64, int64, int64, error) {
+	var first, last, total int64
+
+	rng, size, ok := strings.Cut(strings.TrimPrefix(s, "bytes "), "/")
+	from, to, ok2 := strings.Cut(rng, "-")
+
+	var err error
+	if ok && ok2 {
+		first, err = strconv.ParseInt(from, 10, 64)
+		if err == nil {
+			last, err = strconv.ParseInt(to, 10, 64)
+		}
+		if err == nil {
+			total, err = strconv.ParseInt(size, 10, 64)
+		}
+	}
+	if !ok || !ok2 || err != nil || !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, 0, fmt.Errorf("agehttp: malformed Content-Range: %q", s)
+	}
+
+	return first, last, total, nil
+}
+
+// block returns block index, fetching it unless it's cached or already being
+// fetched.
+func (r *RangeReader) block(index int64) ([]byte, error) {
+	r.mu.Lock()
+	b, ok := r.blocks[index]
+	if !ok {
+		b = &block{done: make(chan struct{})}
+		r.blocks[index] = b
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		r.sem <- struct{}{}
+		b.data, b.err = r.fetch(index)
+		<-r.sem
+
+		r.mu.Lock()
+		if b.err != nil {
+			// Let a later read try again.
+			delete(r.blocks, index)
+		} else {
+			r.cached = append(r.cached, index)
+			for len(r.cached) > r.cacheSize {
+				delete(r.blocks, r.cached[0])
+				r.cached = r.cached[1:]
+			}
+		}
+		r.mu.Unlock()
+
+		close(b.done)
+	}
+
+	<-b.done
+
+	return b.data, b.err
+}
+
+// ReadAt reads len(p) bytes of the resource starting at off, fetching the
+// blocks covering them in parallel.
+func (r *RangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("agehttp: negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	var eof error
+	if int64(len(p)) > r.size-off {
+		p = p[:r.size-off]
+		eof = io.EOF
+	}
+	if len(p) == 0 {
+		return 0, eof
+	}
+
+	end := off + int64(len(p))
+	first := off / r.blockSize
+	last := (end - 1) / r.blockSize
+
+	errs := make([]error, last-first+1)
+
+	var wg sync.WaitGroup
+	for index := first; index <= last; index++ {
+		wg.Add(1)
+
+		go func(index int64) {
+			defer wg.Done()
+
+			data, err := r.block(index)
+			if err != nil {
+				errs[index-first] = err
+
+				return
+			}
+
+			start := index * r.blockSize
+			if start < off {
+				data = data[off-start:]
+				start = off
+			}
+
+			copy(p[start-off:], data)
+		}(index)
+	}
+
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			// Everything before the failed block has been read.
+			n := (first+int64(i))*r.blockSize - off
+			if n < 0 {
+				n = 0
+			}
+
+			return int(n), err
+		}
+	}
+
+	return len(p), eof
+}
@@ -0,0 +1,186 @@
+package agehttp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	age "github.com/bifrosta/age-concurrent"
+)
+
+var (
+	testIdentity, _ = age.GenerateX25519Identity()
+)
+
+func genBytes(length int) []byte {
+	buf := make([]byte, length)
+
+	for i := 0; i < length; i++ {
+		buf[i] = byte(i * 7)
+	}
+
+	return buf
+}
+
+func encrypt(t testing.TB, plaintext []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+
+	w, err := age.Encrypt(buf, testIdentity.Recipient())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = w.Write(plaintext)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+// serve serves data with Range support, counting the requests.
+func serve(t testing.TB, data *[]byte, requests *int64) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(requests, 1)
+
+		content := *data
+
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, len(content)))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestRangeReader(t *testing.T) {
+	data := genBytes(3*4096 + 100)
+
+	var requests int64
+	srv := serve(t, &data, &requests)
+
+	r, err := NewRangeReader(context.Background(), srv.URL, &RangeOptions{BlockSize: 4096, Parallel: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if r.Size() != int64(len(data)) {
+		t.Fatalf("unexpected size: %d", r.Size())
+	}
+
+	ranges := [][2]int{{0, 10}, {4000, 9000}, {0, len(data)}, {len(data) - 5, len(data)}}
+
+	for _, rng := range ranges {
+		buf := make([]byte, rng[1]-rng[0])
+
+		n, err := r.ReadAt(buf, int64(rng[0]))
+		if err != nil && err != io.EOF {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if !bytes.Equal(buf[:n], data[rng[0]:rng[1]]) {
+			t.Fatalf("unexpected output for %v", rng)
+		}
+	}
+
+	// Every block was requested once.
+	if requests != 4 {
+		t.Errorf("unexpected number of requests: %d", requests)
+	}
+
+	_, err = r.ReadAt(make([]byte, 10), int64(len(data)-5))
+	if err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestRangeReaderDecrypt(t *testing.T) {
+	plaintext := genBytes(20*64*1024 + 33)
+	data := encrypt(t, plaintext)
+
+	var requests int64
+	srv := serve(t, &data, &requests)
+
+	r, err := NewRangeReader(context.Background(), srv.URL, &RangeOptions{BlockSize: 256 * 1024})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dec, err := age.DecryptAtN(r, r.Size(), 4, testIdentity)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out := bytes.NewBuffer(nil)
+
+	_, err = io.Copy(out, dec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), plaintext) {
+		t.Fatalf("unexpected output")
+	}
+
+	ra, size, err := age.DecryptReaderAt(r, r.Size(), testIdentity)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if size != int64(len(plaintext)) {
+		t.Fatalf("unexpected size: %d", size)
+	}
+
+	buf := make([]byte, 100000)
+
+	_, err = ra.ReadAt(buf, 500000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(buf, plaintext[500000:600000]) {
+		t.Fatalf("unexpected output")
+	}
+}
+
+func TestRangeReaderErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("no ranges here"))
+	}))
+	defer srv.Close()
+
+	_, err := NewRangeReader(context.Background(), srv.URL, nil)
+	if err == nil || !strings.Contains(err.Error(), "range requests") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	data := genBytes(10000)
+
+	var requests int64
+	srv = serve(t, &data, &requests)
+
+	r, err := NewRangeReader(context.Background(), srv.URL, &RangeOptions{BlockSize: 1000})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Replace the resource, changing its ETag.
+	data = genBytes(10001)
+
+	_, err = r.ReadAt(make([]byte, 100), 5000)
+	if err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package agehttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	age "github.com/bifrosta/age-concurrent"
+	"github.com/bifrosta/age-concurrent/internal/format"
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+const (
+	// ContentType is the media type of age encrypted bodies.
+	ContentType = "application/age-encryption"
+
+	// EncryptedHeader marks age encrypted bodies when the Content-Type
+	// describes the plaintext. Its value is ignored.
+	EncryptedHeader = "Age-Encrypted"
+)
+
+// payloadNonceSize is the size of the nonce between the header and the
+// payload.
+const payloadNonceSize = 16
+
+// Transport is an http.RoundTripper encrypting request bodies and decrypting
+// response bodies.
+//
+// Request bodies are encrypted to Recipients, if any, and sent with the
+// ContentType Content-Type. Responses with the ContentType Content-Type or the
+// EncryptedHeader header are decrypted with Identities, if any.
+//
+// The Content-Length of requests and responses is adjusted when it's known.
+// Encrypted requests can't be replayed, so they don't follow 307 and 308
+// redirects.
+type Transport struct {
+	// Base makes the requests, http.DefaultTransport if nil.
+	Base http.RoundTripper
+
+	Recipients []age.Recipient
+	Identities []age.Identity
+
+	// Concurrent is the number of workers encrypting or decrypting each body.
+	// If less than one, runtime.NumCPU() is used.
+	Concurrent int
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+
+	return t.Base
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.Recipients) > 0 && req.Body != nil {
+		var err error
+		req, err = t.encryptRequest(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := t.base().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(t.Identities) > 0 && isEncrypted(resp) {
+		err = t.decryptResponse(resp)
+		if err != nil {
+			resp.Body.Close()
+
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+// headerBuffer collects the header written by age.EncryptN, then passes the
+// payload to w once it's set.
+type headerBuffer struct {
+	bytes.Buffer
+
+	w io.Writer
+}
+
+func (h *headerBuffer) Write(p []byte) (int, error) {
+	if h.w == nil {
+		return h.Buffer.Write(p)
+	}
+
+	return h.w.Write(p)
+}
+
+type encryptedBody struct {
+	io.Reader
+
+	pr *io.PipeReader
+}
+
+func (b *encryptedBody) Close() error {
+	return b.pr.Close()
+}
+
+func (t *Transport) encryptRequest(req *http.Request) (*http.Request, error) {
+	body := req.Body
+	size := req.ContentLength
+	if body == http.NoBody {
+		// Empty bodies are encrypted too, not sent as is.
+		size = 0
+	} else if size == 0 {
+		size = -1
+	}
+
+	hdr := &headerBuffer{}
+	w, err := age.EncryptN(hdr, t.Concurrent, t.Recipients...)
+	if err != nil {
+		body.Close()
+
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	hdr.w = pw
+
+	// The header and nonce have been written.
+	prefixSize := int64(hdr.Len())
+
+	go func() {
+		defer body.Close()
+
+		_, err := io.Copy(w, body)
+		cerr := w.Close()
+		if err == nil {
+			err = cerr
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	// The original request must not be modified.
+	req = req.Clone(req.Context())
+	req.Body = &encryptedBody{Reader: io.MultiReader(&hdr.Buffer, pr), pr: pr}
+	req.GetBody = nil
+	req.Header.Set("Content-Type", ContentType)
+
+	req.ContentLength = -1
+	if size >= 0 {
+		req.ContentLength = prefixSize + stream.EncryptedSize(size)
+	}
+
+	return req, nil
+}
+
+func isEncrypted(resp *http.Response) bool {
+	if resp.Header.Get(EncryptedHeader) != "" {
+		return true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+
+	return mediaType == ContentType
+}
+
+type decryptedBody struct {
+	io.Reader
+
+	body io.Closer
+}
+
+func (b *decryptedBody) Close() error {
+	return b.body.Close()
+}
+
+func (t *Transport) decryptResponse(resp *http.Response) error {
+	if (resp.Request != nil && resp.Request.Method == http.MethodHead) || resp.Body == http.NoBody {
+		// There is no body to decrypt, or to learn the header size from.
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+
+		return nil
+	}
+
+	// Parse the header first to learn its size.
+	hdr, payload, err := format.Parse(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt response: failed to read header: %w", err)
+	}
+
+	header := &bytes.Buffer{}
+	err = hdr.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt response: %w", err)
+	}
+	headerSize := int64(header.Len())
+
+	r, err := age.DecryptN(io.MultiReader(header, payload), t.Concurrent, t.Identities...)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt response: %w", err)
+	}
+
+	resp.Body = &decryptedBody{Reader: r, body: resp.Body}
+	resp.Header.Del("Content-Length")
+	resp.Header.Del(EncryptedHeader)
+	if resp.Header.Get("Content-Type") == ContentType {
+		resp.Header.Del("Content-Type")
+	}
+
+	size := int64(-1)
+	if resp.ContentLength >= 0 {
+		size, err = stream.DecryptedSize(resp.ContentLength - headerSize - payloadNonceSize)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt response: %w", err)
+		}
+	}
+	resp.ContentLength = size
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package agehttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	age "github.com/bifrosta/age-concurrent"
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+// echo serves back the body of requests, recording what it received.
+func echo(t testing.TB, received *[]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if r.ContentLength >= 0 && r.ContentLength != int64(len(body)) {
+			t.Errorf("expected Content-Length %d, got %d", len(body), r.ContentLength)
+		}
+		*received = body
+
+		w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+		w.Write(body)
+	}))
+}
+
+func TestTransport(t *testing.T) {
+	var received []byte
+	srv := echo(t, &received)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &Transport{
+		Recipients: []age.Recipient{testIdentity.Recipient()},
+		Identities: []age.Identity{testIdentity},
+		Concurrent: 4,
+	}}
+
+	for _, length := range []int{0, 1000, stream.ChunkSize, 3*stream.ChunkSize + 17} {
+		for _, known := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%d/%v", length, known), func(t *testing.T) {
+				plaintext := genBytes(length)
+
+				var body io.Reader = bytes.NewReader(plaintext)
+				if !known {
+					// Hide the length from http.NewRequest.
+					body = io.MultiReader(body)
+				}
+
+				req, err := http.NewRequest(http.MethodPut, srv.URL, body)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				defer resp.Body.Close()
+
+				got, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !bytes.Equal(got, plaintext) {
+					t.Fatalf("plaintext mismatch")
+				}
+				if resp.ContentLength != int64(length) {
+					t.Errorf("expected Content-Length %d, got %d", length, resp.ContentLength)
+				}
+
+				r, err := age.Decrypt(bytes.NewReader(received), testIdentity)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				stored, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !bytes.Equal(stored, plaintext) {
+					t.Fatalf("the server didn't receive the encrypted plaintext")
+				}
+			})
+		}
+	}
+}
+
+func TestTransportPlaintextResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &Transport{Identities: []age.Identity{testIdentity}}}
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestTransportErrors(t *testing.T) {
+	other, _ := age.GenerateX25519Identity()
+
+	var received []byte
+	srv := echo(t, &received)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &Transport{
+		Recipients: []age.Recipient{testIdentity.Recipient()},
+		Identities: []age.Identity{other},
+	}}
+
+	_, err := client.Post(srv.URL, "text/plain", strings.NewReader("hello"))
+	if err == nil {
+		t.Fatalf("expected an error decrypting with the wrong identity")
+	}
+
+	// A corrupted header.
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(EncryptedHeader, "1")
+		io.WriteString(w, "not an age file")
+	}))
+	defer srv.Close()
+
+	_, err = client.Get(srv.URL)
+	if err == nil {
+		t.Fatalf("expected an error for a corrupted response")
+	}
+}
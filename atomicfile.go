@@ -0,0 +1,101 @@
+package age
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+)
+
+// atomicFile is written to a temporary file in the directory of the target,
+// which only replaces the target once Close succeeds.
+type atomicFile struct {
+	*os.File
+
+	path   string
+	closed bool
+}
+
+func createAtomic(path string) (*atomicFile, error) {
+	dir, name := filepath.Dir(path), filepath.Base(path)
+
+	// Like os.Create, a new file gets 0666 minus the umask, while a replaced
+	// file keeps its mode.
+	perm, keep := os.FileMode(0o666), false
+	if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+		perm, keep = info.Mode().Perm(), true
+	}
+
+	for try := 0; ; try++ {
+		var suffix [8]byte
+		if _, err := rand.Read(suffix[:]); err != nil {
+			return nil, err
+		}
+		tmp := filepath.Join(dir, "."+name+".tmp-"+hex.EncodeToString(suffix[:]))
+
+		f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) && try < 100 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if keep {
+			// The umask applied to OpenFile doesn't apply to Chmod.
+			if err := f.Chmod(perm); err != nil {
+				f.Close()
+				os.Remove(tmp)
+
+				return nil, err
+			}
+		}
+
+		return &atomicFile{
+			File: f,
+			path: path,
+		}, nil
+	}
+}
+
+// Close syncs the temporary file to disk and renames it over the target. On
+// error the temporary file is removed.
+func (f *atomicFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+
+	err := f.File.Sync()
+	if cerr := f.File.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.File.Name(), f.path)
+	}
+	if err != nil {
+		_ = os.Remove(f.File.Name())
+
+		return err
+	}
+
+	// Make the rename durable, where directories can be synced.
+	if d, err := os.Open(filepath.Dir(f.path)); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+
+	return nil
+}
+
+// Abort removes the temporary file and leaves the target untouched. It does
+// nothing after Close.
+func (f *atomicFile) Abort() {
+	if f.closed {
+		return
+	}
+	f.closed = true
+
+	_ = f.File.Close()
+	_ = os.Remove(f.File.Name())
+}
@@ -0,0 +1,135 @@
+package age
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAtomicFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "target")
+
+	f, err := createAtomic(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = f.Write([]byte("hello"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Fatalf("target exists before Close: %v", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Abort after Close must not remove anything.
+	f.Abort()
+
+	out, err := os.ReadFile(path)
+	if err != nil || string(out) != "hello" {
+		t.Fatalf("unexpected output: %q, %v", out, err)
+	}
+
+	f, err = createAtomic(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = f.Write([]byte("broken"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.Abort()
+
+	out, err = os.ReadFile(path)
+	if err != nil || string(out) != "hello" {
+		t.Fatalf("unexpected output: %q, %v", out, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(entries) != 1 {
+		t.Errorf("unexpected files left behind: %v", entries)
+	}
+}
+
+func TestAtomicFileRelative(t *testing.T) {
+	dir := t.TempDir()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	f, err := createAtomic("target")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Abort()
+
+	// The temporary file is next to the target, not in $TMPDIR.
+	if filepath.Dir(f.Name()) != "." {
+		t.Fatalf("temporary file %s not in the directory of the target", f.Name())
+	}
+}
+
+func TestAtomicFileMode(t *testing.T) {
+	dir := t.TempDir()
+
+	// New files get the same mode as with os.Create.
+	ref, err := os.Create(filepath.Join(dir, "ref"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ref.Close()
+	refInfo, err := os.Stat(ref.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	path := filepath.Join(dir, "target")
+	mode := func() os.FileMode {
+		f, err := createAtomic(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return info.Mode().Perm()
+	}
+
+	if m := mode(); m != refInfo.Mode().Perm() {
+		t.Errorf("expected mode %v for a new file, got %v", refInfo.Mode().Perm(), m)
+	}
+
+	// Replaced files keep their mode.
+	if err := os.Chmod(path, 0o640); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m := mode(); m != 0o640 {
+		t.Errorf("expected mode 0640 for a replaced file, got %v", m)
+	}
+}
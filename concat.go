@@ -0,0 +1,155 @@
+package age
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/bifrosta/age-concurrent/internal/format"
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+// Member describes one of the age files read by DecryptConcatN.
+type Member struct {
+	// Index is the position of the member, counting from 0.
+	Index int
+
+	// Offset is the position of the header of the member in the source.
+	Offset int64
+
+	// PlaintextOffset is the position of the plaintext of the member in the
+	// output of the Reader.
+	PlaintextOffset int64
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+type concatReader struct {
+	src        *bufio.Reader
+	counter    *countingReader
+	concurrent int
+	identities []Identity
+	boundary   func(Member) error
+
+	member    Member
+	r         io.Reader
+	plaintext int64
+	err       error
+}
+
+// DecryptConcat decrypts age files written back to back into src, each one
+// encrypted to one or more identities, and returns the concatenation of their
+// plaintexts.
+//
+// This will use runtime.NumCPU() as the number of concurrent workers.
+func DecryptConcat(src io.Reader, boundary func(Member) error, identities ...Identity) (io.Reader, error) {
+	return DecryptConcatN(src, 0, boundary, identities...)
+}
+
+// DecryptConcatN decrypts age files written back to back into src, each one
+// encrypted to one or more identities, and returns the concatenation of their
+// plaintexts.
+//
+// The end of every payload is found by authenticating its final chunk, after
+// which the header of the next file is read from src and a new pipeline of
+// concurrent workers is started. If boundary is not nil, it's called with
+// every member once its header has been decrypted, before any of its
+// plaintext is returned. An error from boundary stops decryption, and is
+// returned by Read, or by DecryptConcatN for the first member.
+//
+// src must hold at least one age file. Data following the last file which
+// isn't the header of another one fails with a *stream.ChunkError, or with an
+// error reading the header.
+func DecryptConcatN(src io.Reader, concurrent int, boundary func(Member) error, identities ...Identity) (io.Reader, error) {
+	counter := &countingReader{r: src}
+
+	c := &concatReader{
+		src:        bufio.NewReaderSize(counter, stream.BeforeBufferSize([]byte(format.Intro))),
+		counter:    counter,
+		concurrent: concurrent,
+		identities: identities,
+		boundary:   boundary,
+		member:     Member{Index: -1},
+	}
+
+	err := c.nextMember()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// offset returns the position in src of the next byte of c.src.
+func (c *concatReader) offset() int64 {
+	return c.counter.n - int64(c.src.Buffered())
+}
+
+// nextMember reads the header of the next member and starts decrypting it.
+func (c *concatReader) nextMember() error {
+	c.member = Member{
+		Index:           c.member.Index + 1,
+		Offset:          c.offset(),
+		PlaintextOffset: c.plaintext,
+	}
+
+	// As src is a *bufio.Reader, the payload is read from it too, without
+	// reading ahead.
+	fileKey, _, payload, err := decryptHeader(c.src, c.identities)
+	if err != nil {
+		return c.wrap(err)
+	}
+
+	nonce, err := readNonce(payload)
+	if err != nil {
+		return c.wrap(err)
+	}
+
+	c.r, err = stream.NewPayloadReaderBefore(streamKey(fileKey, nonce), c.src, []byte(format.Intro), c.concurrent)
+	if err != nil {
+		return err
+	}
+
+	if c.boundary != nil {
+		return c.boundary(c.member)
+	}
+
+	return nil
+}
+
+func (c *concatReader) wrap(err error) error {
+	return fmt.Errorf("member %d at offset %d: %w", c.member.Index, c.member.Offset, err)
+}
+
+func (c *concatReader) Read(p []byte) (int, error) {
+	for c.err == nil {
+		n, err := c.r.Read(p)
+		c.plaintext += int64(n)
+
+		if err == io.EOF {
+			if _, perr := c.src.Peek(1); perr == io.EOF {
+				c.err = io.EOF
+			} else {
+				c.err = c.nextMember()
+			}
+		} else if err != nil {
+			c.err = c.wrap(err)
+		}
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+
+	return 0, c.err
+}
@@ -0,0 +1,120 @@
+package age
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+func TestDecryptConcat(t *testing.T) {
+	buf := &bytes.Buffer{}
+	var expected []Member
+	var plaintext string
+
+	for i, c := range cases {
+		expected = append(expected, Member{
+			Index:           i,
+			Offset:          int64(buf.Len()),
+			PlaintextOffset: int64(len(plaintext)),
+		})
+		plaintext += c
+
+		w, err := EncryptN(buf, 2, recipient1)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_, err = io.WriteString(w, c)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	var members []Member
+	r, err := DecryptConcatN(bytes.NewReader(buf.Bytes()), 3, func(m Member) error {
+		members = append(members, m)
+
+		return nil
+	}, ident)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(data) != plaintext {
+		t.Fatalf("plaintext mismatch")
+	}
+
+	if len(members) != len(expected) {
+		t.Fatalf("expected %d members, got %d", len(expected), len(members))
+	}
+	for i := range members {
+		if members[i] != expected[i] {
+			t.Errorf("expected member %+v, got %+v", expected[i], members[i])
+		}
+	}
+}
+
+func TestDecryptConcatErrors(t *testing.T) {
+	file := encryptString(t, genString(100000))
+
+	decrypt := func(src []byte) error {
+		r, err := DecryptConcatN(bytes.NewReader(src), 2, nil, ident)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.ReadAll(r)
+
+		return err
+	}
+
+	// Trailing data which isn't an age file.
+	full := encryptString(t, genString(2*stream.ChunkSize))
+	err := decrypt(append(full, "garbage"...))
+	if !errors.Is(err, stream.ErrTrailingData) {
+		t.Fatalf("expected a trailing data error, got %v", err)
+	}
+	err = decrypt(append(append([]byte{}, file...), "garbage"...))
+	if !errors.Is(err, stream.ErrAuthFailed) {
+		t.Fatalf("expected an authentication error, got %v", err)
+	}
+
+	// A truncated second member.
+	err = decrypt(append(append([]byte{}, file...), file[:len(file)-10]...))
+	var chunkErr *stream.ChunkError
+	if !errors.As(err, &chunkErr) {
+		t.Fatalf("expected a chunk error, got %v", err)
+	}
+
+	// A truncated header.
+	err = decrypt(append(append([]byte{}, file...), file[:30]...))
+	if err == nil {
+		t.Fatalf("expected an error for a truncated header")
+	}
+
+	// A boundary error stops decryption.
+	stop := errors.New("stop")
+	r, err := DecryptConcatN(bytes.NewReader(append(append([]byte{}, file...), file...)), 2, func(m Member) error {
+		if m.Index == 1 {
+			return stop
+		}
+
+		return nil
+	}, ident)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != stop || len(data) != 100000 {
+		t.Fatalf("expected the boundary error after the first member, got %v", err)
+	}
+}
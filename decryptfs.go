@@ -0,0 +1,298 @@
+package age
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bifrosta/age-concurrent/internal/format"
+	"github.com/bifrosta/age-concurrent/internal/readerat"
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+const encryptedExt = ".age"
+
+// NewDecryptingFS returns a read-only file system of the decrypted contents of
+// the *.age files in base, with the suffix stripped. Directories are kept, and
+// other files are hidden.
+//
+// Files are decrypted with random access: Read, Seek and ReadAt only decrypt
+// the chunks they cover. The returned file system also implements fs.StatFS
+// and fs.ReadDirFS. Sizes reported by Stat and ReadDir are computed from the
+// ciphertext size and header without decrypting the file, while the size of
+// an opened file has been authenticated.
+//
+// Files of base must implement io.ReaderAt or io.Seeker, as those opened from
+// os.DirFS, embed.FS and fstest.MapFS do.
+//
+// This will use runtime.NumCPU() as the number of concurrent workers.
+func NewDecryptingFS(base fs.FS, identities ...Identity) fs.FS {
+	return NewDecryptingFSN(base, 0, identities...)
+}
+
+// NewDecryptingFSN returns a read-only file system of the decrypted contents
+// of the *.age files in base.
+//
+// It behaves like NewDecryptingFS, but allows the caller to specify the number
+// of concurrent workers to use for each read.
+func NewDecryptingFSN(base fs.FS, concurrent int, identities ...Identity) fs.FS {
+	return &decryptingFS{
+		base:       base,
+		concurrent: concurrent,
+		identities: identities,
+	}
+}
+
+type decryptingFS struct {
+	base       fs.FS
+	concurrent int
+	identities []Identity
+}
+
+var (
+	_ fs.StatFS    = (*decryptingFS)(nil)
+	_ fs.ReadDirFS = (*decryptingFS)(nil)
+)
+
+func (d *decryptingFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	f, err := d.base.Open(name + encryptedExt)
+	if err == nil {
+		file, err := d.openFile(name, f)
+		if err != nil {
+			f.Close()
+
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		return file, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	info, err := fs.Stat(d.base, name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: unwrapPathError(err)}
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	entries, err := d.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptedDir{info: info, entries: entries}, nil
+}
+
+func (d *decryptingFS) openFile(name string, f fs.File) (fs.File, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fs.ErrNotExist
+	}
+
+	src, err := readerat.FromFile(f)
+	if err != nil {
+		return nil, err
+	}
+
+	r, size, err := DecryptReaderAtN(src, info.Size(), d.concurrent, d.identities...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptedFile{
+		SectionReader: io.NewSectionReader(r, 0, size),
+		src:           f,
+		info:          &decryptedInfo{FileInfo: info, name: path.Base(name), size: size},
+	}, nil
+}
+
+func (d *decryptingFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	info, err := d.statFile(name)
+	if err == nil {
+		return info, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	info, err = fs.Stat(d.base, name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: unwrapPathError(err)}
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return info, nil
+}
+
+// statFile returns the FileInfo of the decrypted file name, reading only the
+// header of name.age.
+func (d *decryptingFS) statFile(name string) (fs.FileInfo, error) {
+	f, err := d.base.Open(name + encryptedExt)
+	if err != nil {
+		return nil, unwrapPathError(err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fs.ErrNotExist
+	}
+
+	hdr, _, err := format.Parse(f)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := stream.DecryptedSize(info.Size() - headerSize(hdr) - streamNonceSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptedInfo{FileInfo: info, name: path.Base(name), size: size}, nil
+}
+
+func (d *decryptingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	base, err := fs.ReadDir(d.base, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// decryptedName returns the name of the decrypted file for an entry of
+	// base, or false if it isn't an encrypted file.
+	decryptedName := func(e fs.DirEntry) (string, bool) {
+		if !e.Type().IsRegular() || !strings.HasSuffix(e.Name(), encryptedExt) || e.Name() == encryptedExt {
+			return "", false
+		}
+
+		return strings.TrimSuffix(e.Name(), encryptedExt), true
+	}
+
+	files := make(map[string]bool)
+	for _, e := range base {
+		if n, ok := decryptedName(e); ok {
+			files[n] = true
+		}
+	}
+
+	var entries []fs.DirEntry
+	for _, e := range base {
+		if n, ok := decryptedName(e); ok {
+			entries = append(entries, &decryptedEntry{fsys: d, name: n, path: path.Join(name, n)})
+		} else if e.IsDir() && !files[e.Name()] {
+			// A decrypted file with the same name shadows the directory, as
+			// in Open.
+			entries = append(entries, e)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+// unwrapPathError returns the error of a *fs.PathError of base, so it can be
+// reported with the path of the decrypting file system.
+func unwrapPathError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+
+	return err
+}
+
+type decryptedInfo struct {
+	fs.FileInfo
+
+	name string
+	size int64
+}
+
+func (i *decryptedInfo) Name() string { return i.name }
+func (i *decryptedInfo) Size() int64  { return i.size }
+func (i *decryptedInfo) Sys() any     { return nil }
+
+type decryptedFile struct {
+	*io.SectionReader
+
+	src  fs.File
+	info fs.FileInfo
+}
+
+func (f *decryptedFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *decryptedFile) Close() error               { return f.src.Close() }
+
+// decryptedEntry is a decrypted file in a directory listing. Its FileInfo is
+// only read when requested.
+type decryptedEntry struct {
+	fsys *decryptingFS
+	name string
+	path string
+}
+
+func (e *decryptedEntry) Name() string      { return e.name }
+func (e *decryptedEntry) IsDir() bool       { return false }
+func (e *decryptedEntry) Type() fs.FileMode { return 0 }
+
+func (e *decryptedEntry) Info() (fs.FileInfo, error) {
+	info, err := e.fsys.statFile(e.path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: e.path, Err: err}
+	}
+
+	return info, nil
+}
+
+type decryptedDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *decryptedDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *decryptedDir) Close() error               { return nil }
+
+func (d *decryptedDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *decryptedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	d.offset += len(entries)
+
+	return entries, nil
+}
@@ -0,0 +1,115 @@
+package age
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+func encryptString(t testing.TB, s string) []byte {
+	r, err := encryptReader(strings.NewReader(s), recipient1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return r.(*bytes.Buffer).Bytes()
+}
+
+func TestDecryptingFS(t *testing.T) {
+	files := map[string]string{
+		"empty":         "",
+		"a.txt":         "hello",
+		"dir/b":         genString(3*stream.ChunkSize + 100),
+		"dir/sub/c.bin": genString(stream.ChunkSize),
+	}
+
+	base := fstest.MapFS{
+		"plain.txt":      &fstest.MapFile{Data: []byte("not encrypted")},
+		"dir/other.json": &fstest.MapFile{Data: []byte("{}")},
+	}
+	for name, content := range files {
+		base[name+".age"] = &fstest.MapFile{Data: encryptString(t, content)}
+	}
+
+	fsys := NewDecryptingFSN(base, 3, ident)
+
+	err := fstest.TestFS(fsys, "empty", "a.txt", "dir/b", "dir/sub/c.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(data) != content {
+			t.Fatalf("%s: plaintext mismatch", name)
+		}
+
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if info.Size() != int64(len(content)) {
+			t.Errorf("%s: expected size %d, got %d", name, len(content), info.Size())
+		}
+	}
+
+	f, err := fsys.Open("dir/b")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 1000)
+	_, err = f.(io.ReaderAt).ReadAt(buf, 2*stream.ChunkSize-500)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != files["dir/b"][2*stream.ChunkSize-500:2*stream.ChunkSize+500] {
+		t.Fatalf("plaintext mismatch")
+	}
+
+	for _, name := range []string{"plain.txt", "plain", "a.txt.age", "dir/other.json", "missing"} {
+		_, err := fsys.Open(name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: expected fs.ErrNotExist, got %v", name, err)
+		}
+	}
+}
+
+func TestDecryptingFSErrors(t *testing.T) {
+	tampered := encryptString(t, genString(2*stream.ChunkSize))
+	tampered[len(tampered)-stream.ChunkSize-100] ^= 0x01
+
+	base := fstest.MapFS{
+		"wrong.age":    &fstest.MapFile{Data: encryptString(t, "hello")},
+		"tampered.age": &fstest.MapFile{Data: tampered},
+	}
+
+	_, err := NewDecryptingFS(base, ident).Open("wrong")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	other, _ := GenerateX25519Identity()
+
+	_, err = NewDecryptingFS(base, other).Open("wrong")
+	var noMatch *NoIdentityMatchError
+	if !errors.As(err, &noMatch) {
+		t.Fatalf("expected a *NoIdentityMatchError, got %v", err)
+	}
+
+	_, err = fs.ReadFile(NewDecryptingFS(base, ident), "tampered")
+	var chunkErr *stream.ChunkError
+	if !errors.As(err, &chunkErr) {
+		t.Fatalf("expected a *stream.ChunkError, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package age
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+// ErrPayloadMismatch is returned by DecryptDetached when the first chunk of the
+// payload doesn't authenticate with the file key of the header, usually as the
+// payload belongs to another header.
+var ErrPayloadMismatch = errors.New("payload doesn't belong to the header")
+
+// EncryptDetached encrypts a file to one or more recipients, writing the age
+// header to header and the payload to payload.
+//
+// The payload starts with the payload nonce, and is followed by the encrypted
+// chunks, so header and payload concatenated are a regular age file. The
+// header can be replaced with RewrapHeader without touching the payload.
+//
+// The caller must call Close on the WriteCloser when done for the last chunk
+// to be encrypted and flushed to payload.
+//
+// This will use runtime.NumCPU() as the number of concurrent workers.
+func EncryptDetached(header, payload io.Writer, recipients ...Recipient) (io.WriteCloser, error) {
+	return EncryptDetachedN(header, payload, 0, recipients...)
+}
+
+// EncryptDetachedN encrypts a file to one or more recipients, writing the age
+// header to header and the payload to payload.
+//
+// It behaves like EncryptDetached, but allows the caller to specify the
+// number of concurrent workers to use.
+func EncryptDetachedN(header, payload io.Writer, concurrent int, recipients ...Recipient) (io.WriteCloser, error) {
+	fileKey, hdr, err := encryptHeader(recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hdr.Marshal(header); err != nil {
+		return nil, fmt.Errorf("failed to write header: %v", err)
+	}
+
+	nonce, err := writeNonce(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return stream.NewPayloadWriter(streamKey(fileKey, nonce), payload, concurrent)
+}
+
+// DecryptDetached decrypts a file encrypted to one or more identities, whose
+// header and payload are read from separate readers, as written by
+// EncryptDetached.
+//
+// The first chunk of the payload is authenticated before returning, and a
+// payload that wasn't encrypted for the header fails with ErrPayloadMismatch.
+//
+// This will use runtime.NumCPU() as the number of concurrent workers.
+func DecryptDetached(header, payload io.Reader, identities ...Identity) (io.Reader, error) {
+	return DecryptDetachedN(header, payload, 0, identities...)
+}
+
+// DecryptDetachedN decrypts a file encrypted to one or more identities, whose
+// header and payload are read from separate readers.
+//
+// It behaves like DecryptDetached, but allows the caller to specify the
+// number of concurrent workers to use.
+func DecryptDetachedN(header, payload io.Reader, concurrent int, identities ...Identity) (io.Reader, error) {
+	fileKey, err := decryptDetachedHeader(header, identities)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := readNonce(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	key := streamKey(fileKey, nonce)
+
+	src := bufio.NewReaderSize(payload, int(stream.EncryptedSize(stream.ChunkSize)))
+	err = checkFirstChunk(key, src)
+	if err != nil {
+		return nil, err
+	}
+
+	return stream.NewPayloadReader(key, src, concurrent)
+}
+
+// RewrapHeader reads a header written by EncryptDetached, unwraps its file
+// key with one of the identities, and writes to dst a new header wrapping the
+// same file key to the recipients. The payload is left unchanged, and can be
+// decrypted with the new header only.
+func RewrapHeader(dst io.Writer, header io.Reader, identities []Identity, recipients ...Recipient) error {
+	fileKey, err := decryptDetachedHeader(header, identities)
+	if err != nil {
+		return err
+	}
+
+	hdr, err := wrapHeader(fileKey, recipients)
+	if err != nil {
+		return err
+	}
+
+	if err := hdr.Marshal(dst); err != nil {
+		return fmt.Errorf("failed to write header: %v", err)
+	}
+
+	return nil
+}
+
+// decryptDetachedHeader unwraps the file key of a header, which must not be
+// followed by anything.
+func decryptDetachedHeader(header io.Reader, identities []Identity) ([]byte, error) {
+	fileKey, _, rest, err := decryptHeader(header, identities)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.ReadFull(rest, make([]byte, 1))
+	if err == nil {
+		return nil, errors.New("unexpected data after the header")
+	}
+	if err != io.EOF {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	return fileKey, nil
+}
+
+// checkFirstChunk authenticates the first chunk of payload with key, either
+// as a full chunk or as the final one, without consuming it.
+func checkFirstChunk(key []byte, payload *bufio.Reader) error {
+	chunk, err := payload.Peek(int(stream.EncryptedSize(stream.ChunkSize)))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if len(chunk) < chacha20poly1305.Overhead {
+		// Let the stream report the truncated payload.
+		return nil
+	}
+
+	a, err := chacha20poly1305.New(key)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	plaintext := make([]byte, 0, stream.ChunkSize)
+
+	if _, err := a.Open(plaintext, nonce, chunk, nil); err == nil {
+		return nil
+	}
+
+	// The last chunk flag.
+	nonce[len(nonce)-1] = 1
+	if _, err := a.Open(plaintext, nonce, chunk, nil); err == nil {
+		return nil
+	}
+
+	return ErrPayloadMismatch
+}
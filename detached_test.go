@@ -0,0 +1,134 @@
+package age
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	realage "filippo.io/age"
+)
+
+func encryptDetached(t testing.TB, plaintext string) ([]byte, []byte) {
+	header, payload := &bytes.Buffer{}, &bytes.Buffer{}
+
+	w, err := EncryptDetachedN(header, payload, 2, recipient1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = io.WriteString(w, plaintext)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return header.Bytes(), payload.Bytes()
+}
+
+func TestDetached(t *testing.T) {
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%d", len(c)), func(t *testing.T) {
+			header, payload := encryptDetached(t, c)
+
+			r, err := DecryptDetachedN(bytes.NewReader(header), bytes.NewReader(payload), 2, ident)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(data) != c {
+				t.Fatalf("plaintext mismatch")
+			}
+
+			// Header and payload together are a regular age file.
+			r, err = realage.Decrypt(Combine(header, bytes.NewReader(payload)), ident)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			data, err = io.ReadAll(r)
+			if err != nil || string(data) != c {
+				t.Fatalf("plaintext mismatch (%v)", err)
+			}
+		})
+	}
+}
+
+func TestRewrapHeader(t *testing.T) {
+	header, payload := encryptDetached(t, genString(100000))
+
+	ident2, err := realage.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	newHeader := &bytes.Buffer{}
+	err = RewrapHeader(newHeader, bytes.NewReader(header), []Identity{ident}, ident2.Recipient())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r, err := DecryptDetached(bytes.NewReader(newHeader.Bytes()), bytes.NewReader(payload), ident2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil || string(data) != genString(100000) {
+		t.Fatalf("plaintext mismatch (%v)", err)
+	}
+
+	_, err = DecryptDetached(bytes.NewReader(newHeader.Bytes()), bytes.NewReader(payload), ident)
+	if err == nil {
+		t.Fatalf("expected an error decrypting the new header with the old identity")
+	}
+}
+
+func TestDetachedMismatch(t *testing.T) {
+	header, _ := encryptDetached(t, "hello")
+	_, payload := encryptDetached(t, "hello")
+
+	_, err := DecryptDetached(bytes.NewReader(header), bytes.NewReader(payload), ident)
+	if !errors.Is(err, ErrPayloadMismatch) {
+		t.Fatalf("expected ErrPayloadMismatch, got %v", err)
+	}
+
+	// A header followed by data isn't a detached header.
+	_, err = DecryptDetached(bytes.NewReader(append(header, payload...)), bytes.NewReader(payload), ident)
+	if err == nil {
+		t.Fatalf("expected an error for data after the header")
+	}
+
+	// Even if a read returns nothing before the data.
+	header, payload = encryptDetached(t, "hello")
+	src := &stutterReader{reads: [][]byte{header, nil, []byte("x")}}
+	_, err = DecryptDetached(src, bytes.NewReader(payload), ident)
+	if err == nil {
+		t.Fatalf("expected an error for data after an empty read")
+	}
+}
+
+// stutterReader returns reads one at a time, including empty ones.
+type stutterReader struct {
+	reads [][]byte
+}
+
+func (s *stutterReader) Read(p []byte) (int, error) {
+	if len(s.reads) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, s.reads[0])
+	s.reads[0] = s.reads[0][n:]
+	if len(s.reads[0]) == 0 {
+		s.reads = s.reads[1:]
+	}
+
+	return n, nil
+}
@@ -0,0 +1,330 @@
+package age
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+// DirOptions configures a Dir. A nil *DirOptions uses the defaults.
+type DirOptions struct {
+	// Concurrent is the number of concurrent workers. If less than one,
+	// runtime.NumCPU() is used.
+	Concurrent int
+
+	// NameKey, if not nil, is used to encrypt file names, so that directory
+	// listings don't reveal them. It must be at least 32 bytes, and must be
+	// the same every time the directory is opened.
+	NameKey []byte
+}
+
+// Dir is a directory of age encrypted files, stored as <name>.age.
+//
+// Names are slash-separated paths as accepted by fs.ValidPath, and their
+// elements must not start with a dot, which is reserved for temporary files.
+// Subdirectories are created as needed.
+//
+// If names are encrypted, every path element is encrypted deterministically
+// on its own, using an HMAC-SHA-256 of the element as the nonce of XChaCha20,
+// so the same name always maps to the same file. The lengths of the elements
+// and the structure of the tree are not hidden.
+type Dir struct {
+	root       string
+	recipients []Recipient
+	identities []Identity
+	concurrent int
+
+	macKey []byte
+	encKey []byte
+}
+
+// nameEncoding is case-insensitive, for file systems that are too.
+var nameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// OpenDir returns a Dir rooted at root, creating it if needed. Files are
+// encrypted to recipients and decrypted with identities. Either can be empty,
+// for a Dir that can only be read or written.
+func OpenDir(root string, recipients []Recipient, identities []Identity, opts *DirOptions) (*Dir, error) {
+	if opts == nil {
+		opts = &DirOptions{}
+	}
+
+	d := &Dir{
+		root:       root,
+		recipients: recipients,
+		identities: identities,
+		concurrent: opts.Concurrent,
+	}
+
+	if opts.NameKey != nil {
+		if len(opts.NameKey) < 32 {
+			return nil, errors.New("name key must be at least 32 bytes")
+		}
+
+		keys := make([]byte, 64)
+		_, err := io.ReadFull(hkdf.New(sha256.New, opts.NameKey, nil, []byte("age-concurrent dir names")), keys)
+		if err != nil {
+			return nil, err
+		}
+
+		d.macKey = keys[:32]
+		d.encKey = keys[32:]
+	}
+
+	err := os.MkdirAll(root, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *Dir) encodeElem(elem string) string {
+	if d.encKey == nil {
+		return elem
+	}
+
+	mac := hmac.New(sha256.New, d.macKey)
+	mac.Write([]byte(elem))
+	nonce := mac.Sum(nil)[:chacha20.NonceSizeX]
+
+	c, _ := chacha20.NewUnauthenticatedCipher(d.encKey, nonce)
+
+	out := make([]byte, len(nonce)+len(elem))
+	copy(out, nonce)
+	c.XORKeyStream(out[len(nonce):], []byte(elem))
+
+	return nameEncoding.EncodeToString(out)
+}
+
+func (d *Dir) decodeElem(encoded string) (string, error) {
+	if d.encKey == nil {
+		return encoded, nil
+	}
+
+	data, err := nameEncoding.DecodeString(encoded)
+	if err != nil || len(data) < chacha20.NonceSizeX {
+		return "", errors.New("invalid encrypted name")
+	}
+
+	nonce := data[:chacha20.NonceSizeX]
+	c, _ := chacha20.NewUnauthenticatedCipher(d.encKey, nonce)
+
+	elem := make([]byte, len(data)-len(nonce))
+	c.XORKeyStream(elem, data[len(nonce):])
+
+	mac := hmac.New(sha256.New, d.macKey)
+	mac.Write(elem)
+	if !hmac.Equal(mac.Sum(nil)[:chacha20.NonceSizeX], nonce) {
+		return "", errors.New("invalid encrypted name")
+	}
+
+	return string(elem), nil
+}
+
+// path returns the path of the file storing name.
+func (d *Dir) path(name string) (string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return "", fs.ErrInvalid
+	}
+
+	elems := strings.Split(name, "/")
+	for i, elem := range elems {
+		if strings.HasPrefix(elem, ".") {
+			return "", fs.ErrInvalid
+		}
+
+		elems[i] = d.encodeElem(elem)
+	}
+
+	return filepath.Join(d.root, filepath.FromSlash(strings.Join(elems, "/"))) + encryptedExt, nil
+}
+
+// DirWriter encrypts a file of a Dir.
+type DirWriter struct {
+	w io.WriteCloser
+	f *atomicFile
+}
+
+// Write encrypts p.
+func (w *DirWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// Close finishes encrypting the file, and publishes it in place of any
+// previous file of the same name.
+func (w *DirWriter) Close() error {
+	err := w.w.Close()
+	if err != nil {
+		w.f.Abort()
+
+		return err
+	}
+
+	return w.f.Close()
+}
+
+// Abort discards the file, leaving any previous file of the same name
+// untouched. It does nothing after Close.
+func (w *DirWriter) Abort() {
+	// Stop the workers without sealing the last chunk, so that the file is
+	// never a complete age file, even before it's removed.
+	abort(w.w)
+	w.f.Abort()
+}
+
+// Create starts writing the file name, encrypted to the recipients of d with
+// EncryptN. The file only appears in d, replacing any previous one, once Close
+// succeeds. Use Abort to discard it instead.
+func (d *Dir) Create(name string) (*DirWriter, error) {
+	path, err := d.path(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: unwrapPathError(err)}
+	}
+
+	f, err := createAtomic(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: unwrapPathError(err)}
+	}
+
+	w, err := EncryptN(f, d.concurrent, d.recipients...)
+	if err != nil {
+		f.Abort()
+
+		return nil, err
+	}
+
+	return &DirWriter{w: w, f: f}, nil
+}
+
+type dirReader struct {
+	io.Reader
+
+	f *os.File
+}
+
+func (r *dirReader) Close() error {
+	return r.f.Close()
+}
+
+// Open decrypts the file name with the identities of d using DecryptN.
+func (d *Dir) Open(name string) (io.ReadCloser, error) {
+	path, err := d.path(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: unwrapPathError(err)}
+	}
+
+	r, err := DecryptN(f, d.concurrent, d.identities...)
+	if err != nil {
+		f.Close()
+
+		return nil, err
+	}
+
+	return &dirReader{Reader: r, f: f}, nil
+}
+
+// Rename renames the file oldName to newName, replacing any file of that name.
+func (d *Dir) Rename(oldName, newName string) error {
+	oldPath, err := d.path(oldName)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+	}
+
+	newPath, err := d.path(newName)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: newName, Err: err}
+	}
+
+	err = os.MkdirAll(filepath.Dir(newPath), 0o700)
+	if err == nil {
+		err = os.Rename(oldPath, newPath)
+	}
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: unwrapPathError(err)}
+	}
+
+	return nil
+}
+
+// Remove removes the file name.
+func (d *Dir) Remove(name string) error {
+	path, err := d.path(name)
+	if err == nil {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: unwrapPathError(err)}
+	}
+
+	return nil
+}
+
+// List returns the names of all the files of d, sorted. Temporary files of
+// writers that haven't been closed, and files not ending in .age, are ignored.
+func (d *Dir) List() ([]string, error) {
+	var names []string
+
+	err := filepath.WalkDir(d.root, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == d.root {
+			return nil
+		}
+		if strings.HasPrefix(e.Name(), ".") {
+			if e.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+		if e.IsDir() || !strings.HasSuffix(e.Name(), encryptedExt) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return err
+		}
+
+		elems := strings.Split(strings.TrimSuffix(filepath.ToSlash(rel), encryptedExt), "/")
+		for i, elem := range elems {
+			elems[i], err = d.decodeElem(elem)
+			if err != nil {
+				return &fs.PathError{Op: "list", Path: path, Err: err}
+			}
+		}
+		names = append(names, strings.Join(elems, "/"))
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
@@ -0,0 +1,245 @@
+package age
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeDirFile(t testing.TB, d *Dir, name, content string) {
+	w, err := d.Create(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = io.WriteString(w, content)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func readDirFile(t testing.TB, d *Dir, name string) string {
+	r, err := d.Open(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return string(data)
+}
+
+func TestDir(t *testing.T) {
+	for _, nameKey := range [][]byte{nil, []byte(strings.Repeat("k", 32))} {
+		t.Run(fmt.Sprintf("%v", nameKey != nil), func(t *testing.T) {
+			root := t.TempDir()
+
+			d, err := OpenDir(root, []Recipient{recipient1}, []Identity{ident}, &DirOptions{Concurrent: 2, NameKey: nameKey})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, c := range cases {
+				writeDirFile(t, d, fmt.Sprintf("sub/dir/secret-%d", len(c)), c)
+			}
+			for _, c := range cases {
+				if readDirFile(t, d, fmt.Sprintf("sub/dir/secret-%d", len(c))) != c {
+					t.Fatalf("plaintext mismatch")
+				}
+			}
+
+			writeDirFile(t, d, "a", "first")
+			writeDirFile(t, d, "a", "second")
+			if readDirFile(t, d, "a") != "second" {
+				t.Fatalf("expected the file to be replaced")
+			}
+
+			w, err := d.Create("aborted")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			io.WriteString(w, "discarded")
+			w.Abort()
+
+			err = d.Rename("a", "renamed/b")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if readDirFile(t, d, "renamed/b") != "second" {
+				t.Fatalf("plaintext mismatch")
+			}
+
+			err = d.Remove("sub/dir/secret-0")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			names, err := d.List()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// Several cases have the same length.
+			seen := map[string]bool{"renamed/b": true, "sub/dir/secret-0": true}
+			expected := []string{"renamed/b"}
+			for _, c := range cases {
+				name := fmt.Sprintf("sub/dir/secret-%d", len(c))
+				if !seen[name] {
+					seen[name] = true
+					expected = append(expected, name)
+				}
+			}
+			sort.Strings(expected)
+			if !reflect.DeepEqual(names, expected) {
+				t.Fatalf("expected %v, got %v", expected, names)
+			}
+
+			for _, name := range []string{"a", "aborted", "sub/dir/secret-0"} {
+				_, err := d.Open(name)
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("%s: expected fs.ErrNotExist, got %v", name, err)
+				}
+			}
+
+			err = filepath.WalkDir(root, func(path string, e fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if nameKey != nil && (strings.Contains(path, "secret") || strings.Contains(path, "sub")) {
+					t.Errorf("plaintext name in %s", path)
+				}
+				if strings.HasPrefix(e.Name(), ".") {
+					t.Errorf("leftover temporary file %s", path)
+				}
+
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestDirErrors(t *testing.T) {
+	root := t.TempDir()
+
+	_, err := OpenDir(root, nil, nil, &DirOptions{NameKey: []byte("short")})
+	if err == nil {
+		t.Fatalf("expected an error for a short name key")
+	}
+
+	nameKey := []byte(strings.Repeat("k", 32))
+
+	d, err := OpenDir(root, []Recipient{recipient1}, []Identity{ident}, &DirOptions{NameKey: nameKey})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, name := range []string{"", ".", "../x", "/abs", "a/.hidden", "a//b"} {
+		_, err := d.Create(name)
+		if !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("%q: expected fs.ErrInvalid, got %v", name, err)
+		}
+	}
+
+	writeDirFile(t, d, "file", "content")
+
+	// A file with a name that wasn't encrypted with the key.
+	err = os.WriteFile(filepath.Join(root, "forged.age"), nil, 0o600)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = d.List()
+	if err == nil {
+		t.Fatalf("expected an error for a forged name")
+	}
+
+	// The same directory opened with another key can't read the names.
+	other, err := OpenDir(root, nil, []Identity{ident}, &DirOptions{NameKey: []byte(strings.Repeat("o", 32))})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = other.Open("file")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist, got %v", err)
+	}
+
+	// A Dir without recipients can't create files.
+	_, err = other.Create("file")
+	if err == nil {
+		t.Fatalf("expected an error without recipients")
+	}
+}
+
+// waitGoroutines fails t if the number of goroutines doesn't go back to at
+// most n within a second.
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked: %d running, expected at most %d", runtime.NumGoroutine(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDirWriterAbort(t *testing.T) {
+	d, err := OpenDir(t.TempDir(), []Recipient{recipient1}, []Identity{ident}, &DirOptions{Concurrent: 4})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		w, err := d.Create("aborted")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		io.WriteString(w, "discarded")
+		w.Abort()
+	}
+
+	waitGoroutines(t, before)
+
+	// Abort after Close leaves the file in place.
+	w, err := d.Create("kept")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	io.WriteString(w, "kept")
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w.Abort()
+
+	if readDirFile(t, d, "kept") != "kept" {
+		t.Fatalf("plaintext mismatch")
+	}
+	if _, err := d.Open("aborted"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the aborted file not to exist, got %v", err)
+	}
+}
@@ -0,0 +1,410 @@
+package age
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefetchLimit is the size up to which EncryptDir reads files ahead
+// entirely. Larger files are only opened ahead, and read when encrypted.
+const prefetchLimit = 1024 * 1024
+
+var errStopped = errors.New("stopped")
+
+// dirItem is an entry of the tree encrypted by EncryptDir, loaded ahead by
+// one of the prefetch workers.
+type dirItem struct {
+	path string
+	name string
+
+	info fs.FileInfo
+	link string
+	data []byte
+	file *os.File
+	err  error
+
+	done chan struct{}
+}
+
+func (it *dirItem) load() {
+	defer close(it.done)
+
+	it.info, it.err = os.Lstat(it.path)
+	if it.err != nil {
+		return
+	}
+
+	switch mode := it.info.Mode(); {
+	case mode.IsDir():
+	case mode&fs.ModeSymlink != 0:
+		it.link, it.err = os.Readlink(it.path)
+	case mode.IsRegular():
+		it.file, it.err = os.Open(it.path)
+		if it.err != nil || it.info.Size() > prefetchLimit {
+			return
+		}
+
+		it.data, it.err = io.ReadAll(it.file)
+		it.file.Close()
+		it.file = nil
+	default:
+		it.err = fmt.Errorf("%s: unsupported file type %v", it.path, mode.Type())
+	}
+}
+
+func (it *dirItem) write(tw *tar.Writer) error {
+	hdr, err := tar.FileInfoHeader(it.info, it.link)
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = it.name
+	if it.info.IsDir() {
+		hdr.Name += "/"
+	}
+	// PAX keeps the modification time to the nanosecond.
+	hdr.Format = tar.FormatPAX
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	if it.data != nil {
+		// The file may have changed since it was stat'ed.
+		hdr.Size = int64(len(it.data))
+	}
+
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case it.data != nil:
+		_, err = tw.Write(it.data)
+	case it.file != nil:
+		_, err = io.CopyN(tw, it.file, hdr.Size)
+	}
+
+	return err
+}
+
+// EncryptDir encrypts the directory tree at root to one or more recipients, as
+// a tar stream inside a single age file written to dst.
+//
+// Directories, regular files and symbolic links are archived with their mode
+// and modification time. Other file types fail with an error. Symbolic links
+// are never followed.
+//
+// Files are read ahead by opts.Prefetch goroutines, so that many small files
+// don't leave the encryption workers waiting on the disk. Files of up to 1 MiB
+// are read entirely in memory, larger ones are streamed when their turn comes.
+func EncryptDir(dst io.Writer, root string, opts *Options, recipients ...Recipient) error {
+	w, err := EncryptN(dst, opts.concurrent(), recipients...)
+	if err != nil {
+		return err
+	}
+
+	prefetch := opts.prefetch()
+
+	// items are in the order of the archive, jobs are loaded by the workers.
+	items := make(chan *dirItem, prefetch)
+	jobs := make(chan *dirItem, prefetch)
+	stop := make(chan struct{})
+
+	var walkErr error
+
+	go func() {
+		defer close(items)
+		defer close(jobs)
+
+		walkErr = filepath.WalkDir(root, func(path string, e fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == root {
+				if !e.IsDir() {
+					return fmt.Errorf("%s: not a directory", root)
+				}
+
+				return nil
+			}
+
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+
+			it := &dirItem{path: path, name: filepath.ToSlash(rel), done: make(chan struct{})}
+
+			select {
+			case items <- it:
+			case <-stop:
+				return errStopped
+			}
+
+			// jobs has room for every item in flight.
+			jobs <- it
+
+			return nil
+		})
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(prefetch)
+
+	for i := 0; i < prefetch; i++ {
+		go func() {
+			defer wg.Done()
+
+			for it := range jobs {
+				it.load()
+			}
+		}()
+	}
+
+	tw := tar.NewWriter(w)
+	stopped := false
+
+	for it := range items {
+		<-it.done
+
+		if err == nil {
+			err = it.err
+		}
+		if err == nil {
+			err = it.write(tw)
+		}
+		if it.file != nil {
+			it.file.Close()
+		}
+
+		if err != nil && !stopped {
+			// Keep draining to close the files opened ahead.
+			close(stop)
+			stopped = true
+		}
+	}
+
+	wg.Wait()
+
+	if err == nil && walkErr != errStopped {
+		err = walkErr
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		// Sealing the last chunk would make the truncated archive look
+		// complete.
+		abort(w)
+
+		return err
+	}
+
+	return w.Close()
+}
+
+// localName returns the cleaned name of an archive entry, or an error if it
+// would be extracted outside of the destination.
+func localName(name string) (string, error) {
+	clean := path.Clean(strings.TrimSuffix(name, "/"))
+
+	if clean == "." || !fs.ValidPath(clean) {
+		return "", fmt.Errorf("invalid path %q in archive", name)
+	}
+	if filepath.Separator != '/' && strings.ContainsRune(clean, filepath.Separator) {
+		return "", fmt.Errorf("invalid path %q in archive", name)
+	}
+
+	return clean, nil
+}
+
+// mkdirParents creates the missing parents of name in root, failing if one of
+// them is a symbolic link, which could lead outside of root.
+func mkdirParents(root, name string) error {
+	dir := root
+
+	for _, elem := range strings.Split(path.Dir(name), "/") {
+		if elem == "." {
+			break
+		}
+
+		dir = filepath.Join(dir, elem)
+
+		info, err := os.Lstat(dir)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			err = os.Mkdir(dir, 0o755)
+			if err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case info.Mode()&fs.ModeSymlink != 0:
+			return fmt.Errorf("%s: path in archive traverses a symbolic link", name)
+		case !info.IsDir():
+			return fmt.Errorf("%s: not a directory", dir)
+		}
+	}
+
+	return nil
+}
+
+// DecryptDir decrypts an age file produced by EncryptDir with one or more
+// identities, and extracts its tree into dstRoot, which is created if needed.
+//
+// Entries that would end up outside of dstRoot, either through their path or
+// through a symbolic link extracted earlier, fail with an error, as do entry
+// types other than directories, regular files and symbolic links. Permission
+// bits and modification times are restored, except for the modification time
+// of symbolic links.
+//
+// Every file only appears once it has been extracted completely, but on error
+// the entries extracted so far are left in place.
+func DecryptDir(dstRoot string, src io.Reader, opts *Options, identities ...Identity) error {
+	r, err := DecryptN(src, opts.concurrent(), identities...)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dstRoot, 0o755)
+	if err != nil {
+		return err
+	}
+
+	// Directory metadata is restored last, as extracting their content
+	// changes their modification time and could require write permission.
+	type dirMeta struct {
+		path    string
+		mode    fs.FileMode
+		modTime time.Time
+	}
+	var dirs []dirMeta
+
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name, err := localName(hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		err = mkdirParents(dstRoot, name)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dstRoot, filepath.FromSlash(name))
+		mode := fs.FileMode(hdr.Mode).Perm()
+
+		info, err := os.Lstat(target)
+		exists := err == nil
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if exists && !info.IsDir() {
+				return fmt.Errorf("%s: not a directory", target)
+			}
+			if !exists {
+				err = os.Mkdir(target, 0o755)
+				if err != nil {
+					return err
+				}
+			}
+
+			dirs = append(dirs, dirMeta{path: target, mode: mode, modTime: hdr.ModTime})
+
+		case tar.TypeReg:
+			if exists && info.IsDir() {
+				return fmt.Errorf("%s: is a directory", target)
+			}
+
+			// The file is renamed over the target, so an existing symbolic
+			// link is replaced rather than followed.
+			err = extractFile(target, tr, mode, hdr.ModTime)
+			if err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			if exists && info.IsDir() {
+				return fmt.Errorf("%s: is a directory", target)
+			}
+			if exists {
+				err = os.Remove(target)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = os.Symlink(hdr.Linkname, target)
+			if err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("%s: unsupported entry type %q in archive", hdr.Name, hdr.Typeflag)
+		}
+	}
+
+	// Authenticate the end of the payload, after the end of the tar stream.
+	_, err = io.Copy(io.Discard, r)
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err = os.Chmod(dirs[i].path, dirs[i].mode)
+		if err == nil {
+			err = os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func extractFile(target string, src io.Reader, mode fs.FileMode, modTime time.Time) error {
+	f, err := createAtomic(target)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+
+	_, err = io.Copy(f, src)
+	if err != nil {
+		return err
+	}
+
+	err = f.Chmod(mode)
+	if err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(target, modTime, modTime)
+}
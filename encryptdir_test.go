@@ -0,0 +1,250 @@
+package age
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncryptDecryptDir(t *testing.T) {
+	src := t.TempDir()
+	modTime := time.Date(2023, 5, 6, 7, 8, 9, 123456789, time.UTC)
+
+	files := map[string]string{
+		"big":          genString(prefetchLimit + 3*65536 + 7),
+		"empty":        "",
+		"sub/deep/one": "1",
+	}
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("many/%02d", i)] = genString(i * 1000)
+	}
+
+	for name, content := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+
+		err := os.MkdirAll(filepath.Dir(p), 0o755)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		err = os.WriteFile(p, []byte(content), 0o640)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		err = os.Chtimes(p, modTime, modTime)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	err := os.Chmod(filepath.Join(src, "sub/deep/one"), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = os.Symlink("../big", filepath.Join(src, "sub/link"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = os.Chmod(filepath.Join(src, "sub/deep"), 0o750)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = os.Chtimes(filepath.Join(src, "sub/deep"), modTime, modTime)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+
+	err = EncryptDir(buf, src, &Options{Concurrent: 4, Prefetch: 3}, recipient1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "out")
+
+	err = DecryptDir(dst, bytes.NewReader(buf.Bytes()), nil, ident)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, content := range files {
+		p := filepath.Join(dst, filepath.FromSlash(name))
+
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(data) != content {
+			t.Fatalf("%s: plaintext mismatch", name)
+		}
+
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("%s: expected modification time %v, got %v", name, modTime, info.ModTime())
+		}
+		if name != "sub/deep/one" && info.Mode().Perm() != 0o640 {
+			t.Errorf("%s: unexpected mode %v", name, info.Mode())
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dst, "sub/deep/one"))
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("unexpected mode %v (%v)", info.Mode(), err)
+	}
+
+	info, err = os.Stat(filepath.Join(dst, "sub/deep"))
+	if err != nil || info.Mode().Perm() != 0o750 || !info.ModTime().Equal(modTime) {
+		t.Errorf("unexpected directory metadata %v %v (%v)", info.Mode(), info.ModTime(), err)
+	}
+
+	link, err := os.Readlink(filepath.Join(dst, "sub/link"))
+	if err != nil || link != "../big" {
+		t.Errorf("unexpected link %q (%v)", link, err)
+	}
+}
+
+// encryptTar encrypts a tar stream of the given entries.
+func encryptTar(t testing.TB, entries []*tar.Header) []byte {
+	buf := &bytes.Buffer{}
+
+	w, err := Encrypt(buf, recipient1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tw := tar.NewWriter(w)
+	for _, hdr := range entries {
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		_, err = tw.Write(make([]byte, hdr.Size))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	err = tw.Close()
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestDecryptDirTraversal(t *testing.T) {
+	tests := map[string][]*tar.Header{
+		"parent":   {{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0o644, Size: 1}},
+		"nested":   {{Name: "a/../../evil", Typeflag: tar.TypeReg, Mode: 0o644, Size: 1}},
+		"absolute": {{Name: "/evil", Typeflag: tar.TypeReg, Mode: 0o644, Size: 1}},
+		"symlink": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "link/evil", Typeflag: tar.TypeReg, Mode: 0o644, Size: 1},
+		},
+		"symlink dir": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "link/evil/", Typeflag: tar.TypeDir, Mode: 0o755},
+		},
+		"device": {{Name: "dev", Typeflag: tar.TypeChar, Mode: 0o644}},
+	}
+
+	for name, entries := range tests {
+		t.Run(name, func(t *testing.T) {
+			parent := t.TempDir()
+			dst := filepath.Join(parent, "out")
+
+			err := DecryptDir(dst, bytes.NewReader(encryptTar(t, entries)), nil, ident)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+
+			_, err = os.Lstat(filepath.Join(parent, "evil"))
+			if !os.IsNotExist(err) {
+				t.Fatalf("a file was extracted outside of the destination")
+			}
+		})
+	}
+
+	// A symbolic link is replaced by a file of the same name, not followed.
+	parent := t.TempDir()
+	dst := filepath.Join(parent, "out")
+
+	err := DecryptDir(dst, bytes.NewReader(encryptTar(t, []*tar.Header{
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../evil"},
+		{Name: "link", Typeflag: tar.TypeReg, Mode: 0o644, Size: 1},
+	})), nil, ident)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	info, err := os.Lstat(filepath.Join(dst, "link"))
+	if err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("expected the link to be replaced by a file")
+	}
+
+	_, err = os.Lstat(filepath.Join(parent, "evil"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("a file was extracted outside of the destination")
+	}
+}
+
+func TestEncryptDirErrors(t *testing.T) {
+	buf := &bytes.Buffer{}
+	before := runtime.NumGoroutine()
+
+	err := EncryptDir(buf, filepath.Join(t.TempDir(), "missing"), nil, recipient1)
+	if err == nil {
+		t.Fatalf("expected an error for a missing directory")
+	}
+
+	// The encryption workers are stopped on errors.
+	waitGoroutines(t, before)
+
+	// Unsupported file types fail the whole archive, while files are being
+	// read ahead.
+	src := t.TempDir()
+	for i := 0; i < 20; i++ {
+		err = os.WriteFile(filepath.Join(src, fmt.Sprintf("%02d", i)), []byte("data"), 0o644)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	l, err := net.Listen("unix", filepath.Join(src, "05.sock"))
+	if err != nil {
+		t.Skipf("can't create a socket: %v", err)
+	}
+	defer l.Close()
+
+	buf.Reset()
+	err = EncryptDir(buf, src, &Options{Prefetch: 2}, recipient1)
+	if err == nil || !strings.Contains(err.Error(), "unsupported file type") {
+		t.Fatalf("expected an unsupported file type error, got %v", err)
+	}
+
+	waitGoroutines(t, before)
+
+	// The output of a failed EncryptDir never decrypts as a complete archive.
+	err = DecryptDir(filepath.Join(t.TempDir(), "out"), bytes.NewReader(buf.Bytes()), nil, ident)
+	if err == nil {
+		t.Fatalf("expected an error decrypting the output of a failed EncryptDir")
+	}
+}
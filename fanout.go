@@ -0,0 +1,63 @@
+package age
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+// Destination is one of the age files written by EncryptFanout.
+type Destination struct {
+	// Writer receives the age file.
+	Writer io.Writer
+
+	// Recipients are the recipients of the file, which can be different for
+	// every Destination.
+	Recipients []Recipient
+}
+
+// EncryptFanout encrypts a single plaintext into an independent age file for
+// every destination, each with its own file key and recipients.
+//
+// Writes to the returned WriteCloser are read once, and sealed for all the
+// destinations by one shared set of workers. The caller must call Close on the
+// WriteCloser when done for the last chunks to be encrypted and flushed.
+//
+// This will use runtime.NumCPU() as the number of concurrent workers.
+func EncryptFanout(dsts []Destination) (io.WriteCloser, error) {
+	return EncryptFanoutN(dsts, 0)
+}
+
+// EncryptFanoutN encrypts a single plaintext into an independent age file for
+// every destination.
+//
+// It behaves like EncryptFanout, but allows the caller to specify the number
+// of concurrent workers, shared by all the destinations. A failure to write to
+// one of the destinations stops all of them.
+func EncryptFanoutN(dsts []Destination, concurrent int) (io.WriteCloser, error) {
+	if len(dsts) == 0 {
+		return nil, errors.New("no destinations specified")
+	}
+
+	keys := make([][]byte, 0, len(dsts))
+	writers := make([]io.Writer, 0, len(dsts))
+
+	for i, d := range dsts {
+		fileKey, hdr, err := encryptHeader(d.Recipients)
+		if err != nil {
+			return nil, fmt.Errorf("destination %d: %w", i, err)
+		}
+
+		nonce, err := writeHeader(d.Writer, hdr)
+		if err != nil {
+			return nil, fmt.Errorf("destination %d: %w", i, err)
+		}
+
+		keys = append(keys, streamKey(fileKey, nonce))
+		writers = append(writers, d.Writer)
+	}
+
+	return stream.NewMultiPayloadWriter(keys, writers, concurrent)
+}
@@ -0,0 +1,107 @@
+package age
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	realage "filippo.io/age"
+)
+
+func TestEncryptFanout(t *testing.T) {
+	ident2, err := realage.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%d", len(c)), func(t *testing.T) {
+			bufs := []*bytes.Buffer{{}, {}, {}}
+
+			w, err := EncryptFanoutN([]Destination{
+				{Writer: bufs[0], Recipients: []Recipient{recipient1}},
+				{Writer: bufs[1], Recipients: []Recipient{ident2.Recipient()}},
+				{Writer: bufs[2], Recipients: []Recipient{recipient1, ident2.Recipient()}},
+			}, 3)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			_, err = io.WriteString(w, c)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			err = w.Close()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			decrypt := func(buf *bytes.Buffer, id Identity) string {
+				r, err := realage.Decrypt(bytes.NewReader(buf.Bytes()), id)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				data, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				return string(data)
+			}
+
+			if decrypt(bufs[0], ident) != c || decrypt(bufs[1], ident2) != c || decrypt(bufs[2], ident2) != c {
+				t.Fatalf("plaintext mismatch")
+			}
+
+			// Every file has its own key.
+			_, err = realage.Decrypt(bytes.NewReader(bufs[1].Bytes()), ident)
+			if err == nil {
+				t.Fatalf("expected an error decrypting with the wrong identity")
+			}
+			if bytes.Equal(bufs[0].Bytes()[bufs[0].Len()-16:], bufs[2].Bytes()[bufs[2].Len()-16:]) {
+				t.Fatalf("expected independent payloads")
+			}
+		})
+	}
+}
+
+type failingWriter struct {
+	after int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.after {
+		return 0, errors.New("write error")
+	}
+	f.after -= len(p)
+
+	return len(p), nil
+}
+
+func TestEncryptFanoutWriteError(t *testing.T) {
+	w, err := EncryptFanoutN([]Destination{
+		{Writer: io.Discard, Recipients: []Recipient{recipient1}},
+		{Writer: &failingWriter{after: 1000}, Recipients: []Recipient{recipient1}},
+	}, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = io.WriteString(w, genString(1000000))
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil || !strings.Contains(err.Error(), "destination 1") {
+		t.Fatalf("expected a write error for destination 1, got %v", err)
+	}
+
+	_, err = EncryptFanoutN(nil, 2)
+	if err == nil {
+		t.Fatalf("expected an error without destinations")
+	}
+}
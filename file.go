@@ -0,0 +1,204 @@
+package age
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+// Options configures the file helpers. A nil *Options uses the defaults.
+type Options struct {
+	// Concurrent is the number of concurrent workers. If less than one,
+	// runtime.NumCPU() is used.
+	Concurrent int
+
+	// Prefetch is the number of files EncryptDir reads ahead of the encryption
+	// workers, 8 if zero. Only EncryptDir reads it, the other functions
+	// ignore it.
+	Prefetch int
+}
+
+func (o *Options) concurrent() int {
+	if o == nil {
+		return 0
+	}
+
+	return o.Concurrent
+}
+
+func (o *Options) prefetch() int {
+	if o == nil || o.Prefetch < 1 {
+		return 8
+	}
+
+	return o.Prefetch
+}
+
+// EncryptFile encrypts the file at srcPath to one or more recipients, and
+// writes the age file to dstPath.
+//
+// Where supported, the source is memory mapped and the workers seal chunks
+// directly from the mapped pages into the preallocated output. Sources that
+// can't be mapped, like pipes, are encrypted with EncryptN instead.
+//
+// The output is written to a temporary file in the same directory, which only
+// replaces dstPath once it has been written completely.
+//
+// The source must not be truncated while it's being encrypted: reading the
+// mapped pages past the new end of the file kills the process with SIGBUS.
+func EncryptFile(dstPath, srcPath string, opts *Options, recipients ...Recipient) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	data, unmap, err := mmapFile(src)
+	if err != nil {
+		return encryptFileStream(dstPath, src, opts, recipients)
+	}
+	defer unmap()
+
+	fileKey, hdr, err := encryptHeader(recipients)
+	if err != nil {
+		return err
+	}
+
+	header := bytes.NewBuffer(nil)
+
+	nonce, err := writeHeader(header, hdr)
+	if err != nil {
+		return err
+	}
+
+	dst, err := createAtomic(dstPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Abort()
+
+	offset := int64(header.Len())
+
+	err = dst.Truncate(offset + stream.EncryptedSize(int64(len(data))))
+	if err != nil {
+		return err
+	}
+
+	_, err = dst.WriteAt(header.Bytes(), 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = stream.EncryptBytesToWriterAt(dst, offset, streamKey(fileKey, nonce), data, opts.concurrent())
+	if err != nil {
+		return err
+	}
+
+	return dst.Close()
+}
+
+func encryptFileStream(dstPath string, src io.Reader, opts *Options, recipients []Recipient) error {
+	dst, err := createAtomic(dstPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Abort()
+
+	w, err := EncryptN(dst, opts.concurrent(), recipients...)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, src)
+	if err != nil {
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return dst.Close()
+}
+
+// DecryptFile decrypts the age file at srcPath with one or more identities,
+// and writes the plaintext to dstPath.
+//
+// Where supported, the source is memory mapped and the workers open chunks
+// directly from the mapped pages into the preallocated output. Sources that
+// can't be mapped, like pipes, are decrypted with DecryptToWriterAtN instead.
+//
+// The output is written to a temporary file in the same directory, which only
+// replaces dstPath once the last chunk has been authenticated. On error dstPath
+// is left untouched.
+//
+// The source must not be truncated while it's being decrypted: reading the
+// mapped pages past the new end of the file kills the process with SIGBUS.
+func DecryptFile(dstPath, srcPath string, opts *Options, identities ...Identity) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	data, unmap, err := mmapFile(src)
+	if err != nil {
+		return decryptFileStream(dstPath, src, opts, identities)
+	}
+	defer unmap()
+
+	fileKey, hdr, _, err := decryptHeader(bytes.NewReader(data), identities)
+	if err != nil {
+		return err
+	}
+
+	offset := headerSize(hdr)
+
+	nonce, err := readNonce(bytes.NewReader(data[offset:]))
+	if err != nil {
+		return err
+	}
+
+	payload := data[offset+streamNonceSize:]
+
+	size, err := stream.DecryptedSize(int64(len(payload)))
+	if err != nil {
+		return err
+	}
+
+	dst, err := createAtomic(dstPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Abort()
+
+	err = dst.Truncate(size)
+	if err != nil {
+		return err
+	}
+
+	_, err = stream.DecryptBytesToWriterAt(dst, streamKey(fileKey, nonce), payload, opts.concurrent())
+	if err != nil {
+		return err
+	}
+
+	return dst.Close()
+}
+
+func decryptFileStream(dstPath string, src io.Reader, opts *Options, identities []Identity) error {
+	dst, err := createAtomic(dstPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Abort()
+
+	_, err = DecryptToWriterAtN(dst, src, opts.concurrent(), identities...)
+	if err != nil {
+		return err
+	}
+
+	return dst.Close()
+}
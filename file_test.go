@@ -0,0 +1,126 @@
+package age
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	realage "filippo.io/age"
+)
+
+func TestEncryptDecryptFile(t *testing.T) {
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%d", len(c)), func(t *testing.T) {
+			dir := t.TempDir()
+
+			plainPath := filepath.Join(dir, "plain")
+			encPath := filepath.Join(dir, "plain.age")
+			outPath := filepath.Join(dir, "out")
+
+			err := os.WriteFile(plainPath, []byte(c), 0o600)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			err = EncryptFile(encPath, plainPath, &Options{Concurrent: 3}, recipient1)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			encrypted, err := os.ReadFile(encPath)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			r, err := realage.Decrypt(bytes.NewReader(encrypted), ident)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			out := bytes.NewBuffer(nil)
+
+			_, err = out.ReadFrom(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(out.Bytes(), []byte(c)) {
+				t.Fatalf("unexpected output")
+			}
+
+			err = DecryptFile(outPath, encPath, nil, ident)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			decrypted, err := os.ReadFile(outPath)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(decrypted, []byte(c)) {
+				t.Fatalf("unexpected output")
+			}
+		})
+	}
+}
+
+func TestDecryptFileBroken(t *testing.T) {
+	dir := t.TempDir()
+
+	plainPath := filepath.Join(dir, "plain")
+	encPath := filepath.Join(dir, "plain.age")
+
+	err := os.WriteFile(plainPath, []byte(genString(3*64*1024+10)), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = EncryptFile(encPath, plainPath, nil, recipient1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	encrypted, err := os.ReadFile(encPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, l := range []int{len(encrypted) - 1, len(encrypted) - 10 - 16, 200} {
+		t.Run(fmt.Sprintf("%d", l), func(t *testing.T) {
+			err := os.WriteFile(encPath, encrypted[:l], 0o600)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			outPath := filepath.Join(dir, "out")
+
+			err = os.WriteFile(outPath, []byte("previous"), 0o600)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			err = DecryptFile(outPath, encPath, nil, ident)
+			if err == nil {
+				t.Errorf("expected error, got nil")
+			}
+
+			// The previous output must be untouched, without leftovers.
+			out, err := os.ReadFile(outPath)
+			if err != nil || string(out) != "previous" {
+				t.Errorf("unexpected output: %q, %v", out, err)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(entries) != 3 {
+				t.Errorf("unexpected files left behind: %v", entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package age
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+// ErrReleased is returned by the methods of a FileKeyHandle after Release.
+var ErrReleased = errors.New("file key handle released")
+
+// FileKeyHandle holds the file key of an age file, unwrapped from its header
+// by UnwrapHeader, until the payload is opened.
+//
+// The file key is zeroed by Release, or when the handle is garbage collected
+// if Release wasn't called.
+type FileKeyHandle struct {
+	mu         sync.Mutex
+	fileKey    []byte
+	headerSize int64
+}
+
+// UnwrapHeader reads the header of an age file from src, and unwraps its file
+// key with the first of the identities that can.
+//
+// Only the header is parsed, so UnwrapHeader can check whether an identity can
+// decrypt a file without reading its payload. src may be read past the end of
+// the header; the payload, starting HeaderSize bytes into the file, must be
+// passed to OpenPayload.
+func UnwrapHeader(src io.Reader, identities ...Identity) (*FileKeyHandle, error) {
+	fileKey, hdr, _, err := decryptHeader(src, identities)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &FileKeyHandle{
+		fileKey:    fileKey,
+		headerSize: headerSize(hdr),
+	}
+	runtime.SetFinalizer(h, (*FileKeyHandle).Release)
+
+	return h, nil
+}
+
+// HeaderSize returns the size of the header, which is the offset of the
+// payload in the file.
+func (h *FileKeyHandle) HeaderSize() int64 {
+	return h.headerSize
+}
+
+// streamKey reads the payload nonce from payload, and returns the stream key.
+func (h *FileKeyHandle) streamKey(payload io.Reader) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.fileKey == nil {
+		return nil, ErrReleased
+	}
+
+	nonce, err := readNonce(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return streamKey(h.fileKey, nonce), nil
+}
+
+// OpenPayload returns a Reader decrypting payload, the part of the file
+// following the header, starting with the payload nonce, with concurrent
+// workers. It can be called several times, until Release.
+func (h *FileKeyHandle) OpenPayload(payload io.Reader, concurrent int) (*stream.Reader, error) {
+	key, err := h.streamKey(payload)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(key)
+
+	return stream.NewPayloadReader(key, payload, concurrent)
+}
+
+// OpenPayloadAt is like OpenPayload, but the workers read their chunks from
+// payload concurrently with ReadAt. size is the size of the payload, including
+// the nonce.
+func (h *FileKeyHandle) OpenPayloadAt(payload io.ReaderAt, size int64, concurrent int) (*stream.Reader, error) {
+	if size < streamNonceSize {
+		return nil, errors.New("failed to read nonce: payload too short")
+	}
+
+	key, err := h.streamKey(io.NewSectionReader(payload, 0, streamNonceSize))
+	if err != nil {
+		return nil, err
+	}
+	defer zero(key)
+
+	return stream.NewPayloadReaderAt(key, io.NewSectionReader(payload, streamNonceSize, size-streamNonceSize), size-streamNonceSize, concurrent)
+}
+
+// Release zeroes the file key. The Readers returned by OpenPayload keep
+// working, as they only hold the stream key derived from it.
+func (h *FileKeyHandle) Release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	zero(h.fileKey)
+	h.fileKey = nil
+	runtime.SetFinalizer(h, nil)
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
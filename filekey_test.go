@@ -0,0 +1,64 @@
+package age
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	realage "filippo.io/age"
+)
+
+func TestUnwrapHeader(t *testing.T) {
+	plaintext := genString(200000)
+	file := encryptString(t, plaintext)
+
+	h, err := UnwrapHeader(bytes.NewReader(file), ident)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	payload := file[h.HeaderSize():]
+
+	r, err := h.OpenPayload(bytes.NewReader(payload), 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil || string(data) != plaintext {
+		t.Fatalf("plaintext mismatch (%v)", err)
+	}
+
+	r, err = h.OpenPayloadAt(bytes.NewReader(payload), int64(len(payload)), 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	h.Release()
+
+	// Readers opened before Release keep working.
+	data, err = io.ReadAll(r)
+	if err != nil || string(data) != plaintext {
+		t.Fatalf("plaintext mismatch (%v)", err)
+	}
+
+	_, err = h.OpenPayload(bytes.NewReader(payload), 3)
+	if !errors.Is(err, ErrReleased) {
+		t.Fatalf("expected ErrReleased, got %v", err)
+	}
+}
+
+func TestUnwrapHeaderWrongIdentity(t *testing.T) {
+	file := encryptString(t, "hello")
+
+	other, err := realage.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = UnwrapHeader(bytes.NewReader(file), other)
+	var noMatch *NoIdentityMatchError
+	if !errors.As(err, &noMatch) {
+		t.Fatalf("expected a NoIdentityMatchError, got %v", err)
+	}
+}
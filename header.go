@@ -0,0 +1,298 @@
+package age
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/bifrosta/age-concurrent/internal/format"
+)
+
+// encryptHeader generates a file key and wraps it to the recipients, like the
+// header handling of the real age Encrypt.
+func encryptHeader(recipients []Recipient) ([]byte, *format.Header, error) {
+	fileKey := make([]byte, fileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, nil, err
+	}
+
+	hdr, err := wrapHeader(fileKey, recipients)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return fileKey, hdr, nil
+}
+
+// maxConcurrentWraps is the maximum number of recipients wrapping the file key
+// at the same time. Wrapping is quick for native recipients, but plugins can
+// spend most of their time waiting.
+const maxConcurrentWraps = 32
+
+// RecipientError is returned by the encryption functions when a recipient
+// fails to wrap the file key.
+type RecipientError struct {
+	// Index is the position of the recipient in the list.
+	Index int
+	Err   error
+}
+
+func (e *RecipientError) Error() string {
+	return fmt.Sprintf("failed to wrap key for recipient #%d: %v", e.Index, e.Err)
+}
+
+func (e *RecipientError) Unwrap() error {
+	return e.Err
+}
+
+type wrapResult struct {
+	stanzas []*Stanza
+	labels  []string
+	err     error
+}
+
+// wrapHeader returns a header wrapping fileKey to the recipients. The
+// recipients wrap the file key concurrently, and their stanzas are added in
+// order. If several recipients fail, the error of the first one is returned.
+func wrapHeader(fileKey []byte, recipients []Recipient) (*format.Header, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients specified")
+	}
+	if onlyMetadata(recipients) {
+		return nil, errors.New("no recipients specified besides metadata")
+	}
+
+	results := make([]wrapResult, len(recipients))
+
+	if len(recipients) == 1 {
+		results[0].stanzas, results[0].labels, results[0].err = wrapWithLabels(recipients[0], fileKey)
+	} else {
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, maxConcurrentWraps)
+
+		for i, r := range recipients {
+			wg.Add(1)
+			sem <- struct{}{}
+
+			go func(res *wrapResult, r Recipient) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+
+				res.stanzas, res.labels, res.err = wrapWithLabels(r, fileKey)
+			}(&results[i], r)
+		}
+
+		wg.Wait()
+	}
+
+	hdr := &format.Header{}
+
+	var labels []string
+	for i, res := range results {
+		if res.err != nil {
+			return nil, &RecipientError{Index: i, Err: res.err}
+		}
+
+		sort.Strings(res.labels)
+		if i == 0 {
+			labels = res.labels
+		} else if !slicesEqual(labels, res.labels) {
+			return nil, fmt.Errorf("incompatible recipients")
+		}
+
+		for _, s := range res.stanzas {
+			hdr.Recipients = append(hdr.Recipients, (*format.Stanza)(s))
+		}
+	}
+
+	mac, err := headerMAC(fileKey, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute header MAC: %v", err)
+	}
+	hdr.MAC = mac
+
+	return hdr, nil
+}
+
+func onlyMetadata(recipients []Recipient) bool {
+	for _, r := range recipients {
+		if _, ok := r.(*metadataRecipient); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func wrapWithLabels(r Recipient, fileKey []byte) (s []*Stanza, labels []string, err error) {
+	if r, ok := r.(RecipientWithLabels); ok {
+		return r.WrapWithLabels(fileKey)
+	}
+	s, err = r.Wrap(fileKey)
+	return
+}
+
+func slicesEqual(s1, s2 []string) bool {
+	if len(s1) != len(s2) {
+		return false
+	}
+	for i := range s1 {
+		if s1[i] != s2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeHeader writes the header and a new payload nonce to dst, and returns
+// the nonce.
+func writeHeader(dst io.Writer, hdr *format.Header) ([]byte, error) {
+	if err := hdr.Marshal(dst); err != nil {
+		return nil, fmt.Errorf("failed to write header: %v", err)
+	}
+
+	return writeNonce(dst)
+}
+
+// writeNonce writes a new payload nonce to dst, and returns it.
+func writeNonce(dst io.Writer) ([]byte, error) {
+	nonce := make([]byte, streamNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(nonce); err != nil {
+		return nil, fmt.Errorf("failed to write nonce: %v", err)
+	}
+
+	return nonce, nil
+}
+
+// decryptHeader reads the header from src and unwraps the file key, like the
+// header handling of the real age Decrypt. It returns the file key, the header
+// and a Reader starting at the payload nonce.
+func decryptHeader(src io.Reader, identities []Identity) ([]byte, *format.Header, io.Reader, error) {
+	if len(identities) == 0 {
+		return nil, nil, nil, errors.New("no identities specified")
+	}
+
+	hdr, payload, err := format.Parse(src)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	fileKey, err := unwrapFileKey(hdr, identities)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return fileKey, hdr, payload, nil
+}
+
+// unwrapFileKey tries the identities in order until one unwraps the file key,
+// and verifies the header MAC with it.
+func unwrapFileKey(hdr *format.Header, identities []Identity) ([]byte, error) {
+	fileKey, _, err := unwrapFileKeyIndex(hdr, identities)
+
+	return fileKey, err
+}
+
+// unwrapFileKeyIndex is like unwrapFileKey, but also returns the index of the
+// identity that unwrapped the file key.
+func unwrapFileKeyIndex(hdr *format.Header, identities []Identity) ([]byte, int, error) {
+	stanzas := headerStanzas(hdr)
+
+	errNoMatch := &NoIdentityMatchError{}
+
+	var fileKey []byte
+	index := -1
+	for i, id := range identities {
+		var err error
+		fileKey, err = id.Unwrap(stanzas)
+		if errors.Is(err, ErrIncorrectIdentity) {
+			errNoMatch.Errors = appendIncorrect(errNoMatch.Errors, err)
+			continue
+		}
+		if err != nil {
+			return nil, -1, err
+		}
+
+		index = i
+
+		break
+	}
+	if fileKey == nil {
+		return nil, -1, errNoMatch
+	}
+
+	mac, err := headerMAC(fileKey, hdr)
+	if err != nil {
+		return nil, -1, fmt.Errorf("failed to compute header MAC: %v", err)
+	}
+	if !hmac.Equal(mac, hdr.MAC) {
+		return nil, -1, errors.New("bad header MAC")
+	}
+
+	return fileKey, index, nil
+}
+
+func headerStanzas(hdr *format.Header) []*Stanza {
+	stanzas := make([]*Stanza, 0, len(hdr.Recipients))
+	for _, s := range hdr.Recipients {
+		stanzas = append(stanzas, (*Stanza)(s))
+	}
+
+	return stanzas
+}
+
+// decryptHeaderAt reads the header and nonce of the file of the given size in
+// src, and returns the stream key and the payload following them.
+func decryptHeaderAt(src io.ReaderAt, size int64, identities []Identity) ([]byte, *io.SectionReader, error) {
+	fileKey, hdr, _, err := decryptHeader(io.NewSectionReader(src, 0, size), identities)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	offset := headerSize(hdr)
+
+	nonce, err := readNonce(io.NewSectionReader(src, offset, size-offset))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	offset += streamNonceSize
+
+	return streamKey(fileKey, nonce), io.NewSectionReader(src, offset, size-offset), nil
+}
+
+// readNonce reads the payload nonce following the header.
+func readNonce(payload io.Reader) ([]byte, error) {
+	nonce := make([]byte, streamNonceSize)
+	if _, err := io.ReadFull(payload, nonce); err != nil {
+		return nil, fmt.Errorf("failed to read nonce: %w", err)
+	}
+
+	return nonce, nil
+}
+
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+
+	return len(p), nil
+}
+
+// headerSize returns the encoded size of hdr. The encoding is canonical, so
+// this is also the size of the header as it was parsed.
+func headerSize(hdr *format.Header) int64 {
+	var c countingWriter
+	_ = hdr.Marshal(&c)
+
+	return int64(c)
+}
@@ -0,0 +1,114 @@
+package age
+
+import (
+	"errors"
+	"fmt"
+)
+
+type concurrentIdentities struct {
+	identities []Identity
+	concurrent int
+}
+
+// NoConcurrentIdentityMatchError is returned by the Identity of
+// ConcurrentIdentities when none of its identities matches. It wraps
+// ErrIncorrectIdentity, so that the identities following it are still tried.
+type NoConcurrentIdentityMatchError struct {
+	// Errors holds the errors returned by the Unwrap calls, in the order of
+	// the identities. They all wrap ErrIncorrectIdentity.
+	Errors []error
+}
+
+func (e *NoConcurrentIdentityMatchError) Error() string {
+	return fmt.Sprintf("none of %d identities matched any of the recipients", len(e.Errors))
+}
+
+func (e *NoConcurrentIdentityMatchError) Unwrap() error {
+	return ErrIncorrectIdentity
+}
+
+// appendIncorrect appends err, which wraps ErrIncorrectIdentity, to errs. The
+// errors of a *NoConcurrentIdentityMatchError are appended one by one instead,
+// like the errors of the identities it tried.
+func appendIncorrect(errs []error, err error) []error {
+	var noMatch *NoConcurrentIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return append(errs, noMatch.Errors...)
+	}
+
+	return append(errs, err)
+}
+
+type unwrapResult struct {
+	fileKey []byte
+	err     error
+}
+
+// ConcurrentIdentities returns an Identity trying the identities concurrently,
+// for headers that are slow to unwrap, such as with many identities, plugins
+// or scrypt. Pass it as the only identity to DecryptN or any other function
+// taking identities.
+//
+// At most concurrent Unwrap calls run at the same time, or one per identity if
+// concurrent is less than one. The result is the same as trying the
+// identities in order: the first identity failing with an error other than
+// ErrIncorrectIdentity, or succeeding, decides the outcome, and a
+// *NoConcurrentIdentityMatchError holding all the errors is returned if none
+// matches. Decrypt and the other functions taking identities report these
+// errors one by one in their *NoIdentityMatchError, as if the identities had
+// been passed to them directly.
+//
+// Identities following the one deciding the outcome may still be running, and
+// their results are discarded.
+func ConcurrentIdentities(concurrent int, identities ...Identity) Identity {
+	if concurrent < 1 {
+		concurrent = len(identities)
+	}
+
+	return &concurrentIdentities{
+		identities: identities,
+		concurrent: concurrent,
+	}
+}
+
+func (c *concurrentIdentities) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	results := make([]chan unwrapResult, len(c.identities))
+	for i := range results {
+		results[i] = make(chan unwrapResult, 1)
+	}
+
+	sem := make(chan struct{}, c.concurrent)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i, id := range c.identities {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+
+			go func(id Identity, res chan<- unwrapResult) {
+				defer func() { <-sem }()
+
+				fileKey, err := id.Unwrap(stanzas)
+				res <- unwrapResult{fileKey: fileKey, err: err}
+			}(id, results[i])
+		}
+	}()
+
+	errNoMatch := &NoConcurrentIdentityMatchError{}
+
+	for _, res := range results {
+		r := <-res
+		if errors.Is(r.err, ErrIncorrectIdentity) {
+			errNoMatch.Errors = appendIncorrect(errNoMatch.Errors, r.err)
+			continue
+		}
+
+		return r.fileKey, r.err
+	}
+
+	return nil, errNoMatch
+}
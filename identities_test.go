@@ -0,0 +1,121 @@
+package age
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	realage "filippo.io/age"
+)
+
+// slowIdentity delays Unwrap, and tracks how many calls run at once.
+type slowIdentity struct {
+	Identity
+	delay time.Duration
+	err   error
+	calls *concurrency
+}
+
+func (s *slowIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	defer s.calls.enter()()
+
+	time.Sleep(s.delay)
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return s.Identity.Unwrap(stanzas)
+}
+
+func TestConcurrentIdentities(t *testing.T) {
+	file := encryptString(t, "hello")
+
+	var calls concurrency
+	var identities []Identity
+	for i := 0; i < 20; i++ {
+		other, err := GenerateX25519Identity()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		identities = append(identities, &slowIdentity{Identity: other, delay: 20 * time.Millisecond, calls: &calls})
+	}
+	identities = append(identities, &slowIdentity{Identity: ident, delay: 20 * time.Millisecond, calls: &calls})
+
+	r, err := DecryptN(bytes.NewReader(file), 1, ConcurrentIdentities(8, identities...))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("plaintext mismatch (%v)", err)
+	}
+
+	if peak := calls.max(); peak < 2 || peak > 8 {
+		t.Errorf("expected 2 to 8 concurrent calls, got %d", peak)
+	}
+
+	// None matches.
+	_, err = DecryptN(bytes.NewReader(file), 1, ConcurrentIdentities(0, identities[:5]...))
+	var noMatch *NoIdentityMatchError
+	if !errors.As(err, &noMatch) || len(noMatch.Errors) != 5 {
+		t.Fatalf("expected a NoIdentityMatchError with 5 errors, got %v", err)
+	}
+
+	// Like upstream, with one error per identity.
+	_, upstreamErr := realage.Decrypt(bytes.NewReader(file), identities[:5]...)
+	var upstreamNoMatch *NoIdentityMatchError
+	if !errors.As(upstreamErr, &upstreamNoMatch) || len(upstreamNoMatch.Errors) != len(noMatch.Errors) {
+		t.Fatalf("expected the same errors as upstream, got %v and %v", noMatch.Errors, upstreamErr)
+	}
+	for i, err := range noMatch.Errors {
+		if !errors.Is(err, ErrIncorrectIdentity) || err.Error() != upstreamNoMatch.Errors[i].Error() {
+			t.Errorf("error %d: got %v, upstream %v", i, err, upstreamNoMatch.Errors[i])
+		}
+	}
+
+	// Identities following the wrapper are still tried.
+	r, err = DecryptN(bytes.NewReader(file), 1, ConcurrentIdentities(0, identities[:5]...), ident)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err = io.ReadAll(r)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("plaintext mismatch (%v)", err)
+	}
+}
+
+func TestConcurrentIdentitiesOrder(t *testing.T) {
+	file := encryptString(t, "hello")
+	fatal := errors.New("plugin failed")
+
+	var calls concurrency
+	failing := &slowIdentity{Identity: ident, delay: 50 * time.Millisecond, err: fatal, calls: &calls}
+
+	// A fatal error before a matching identity is returned, like when trying
+	// them in order, even if the match is found first.
+	_, err := DecryptN(bytes.NewReader(file), 1, ConcurrentIdentities(0, failing, ident))
+	if !errors.Is(err, fatal) {
+		t.Fatalf("expected the plugin error, got %v", err)
+	}
+
+	// A match before a fatal error wins.
+	_, err = DecryptN(bytes.NewReader(file), 1, ConcurrentIdentities(0, ident, failing))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// An incorrect identity before a fatal error is skipped.
+	other, _ := GenerateX25519Identity()
+	_, err = DecryptN(bytes.NewReader(file), 1, ConcurrentIdentities(0, other, failing))
+	if !errors.Is(err, fatal) {
+		t.Fatalf("expected the plugin error, got %v", err)
+	}
+
+	_, err = DecryptN(bytes.NewReader(file), 1, ConcurrentIdentities(0))
+	if err == nil {
+		t.Fatalf("expected an error without identities")
+	}
+}
@@ -0,0 +1,41 @@
+// Package readerat provides random access to files that can only seek.
+package readerat
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// seekerReaderAt implements io.ReaderAt for files that can only seek.
+type seekerReaderAt struct {
+	fs.File
+
+	mu sync.Mutex
+}
+
+func (s *seekerReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.File.(io.Seeker).Seek(off, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	return io.ReadFull(s.File, p)
+}
+
+// FromFile returns f as an io.ReaderAt, serializing reads if f can only seek.
+// The result also implements io.Closer, which closes f.
+func FromFile(f fs.File) (io.ReaderAt, error) {
+	switch r := f.(type) {
+	case io.ReaderAt:
+		return r, nil
+	case io.Seeker:
+		return &seekerReaderAt{File: f}, nil
+	}
+
+	return nil, errors.New("file does not implement io.ReaderAt or io.Seeker")
+}
@@ -0,0 +1,168 @@
+package age
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/bifrosta/age-concurrent/internal/format"
+)
+
+type cacheEntry struct {
+	hash    [sha256.Size]byte
+	fileKey []byte
+	expires time.Time
+
+	// byAge is the element of the entry in CachedIdentity.byAge.
+	byAge *list.Element
+}
+
+// CachedIdentity is an Identity remembering the file keys unwrapped by
+// another one, so that decrypting a file with the same header again skips the
+// wrapped Identity, for example a scrypt passphrase or a plugin backed by an
+// HSM. It's safe for concurrent use.
+//
+// Entries are keyed by a SHA-256 hash of the recipient stanzas, and only hold
+// file keys the wrapped Identity unwrapped itself, so the cache doesn't give
+// access to files the Identity couldn't decrypt. The header MAC is still
+// verified with the cached file key. Errors are not cached.
+//
+// Every file key is held for the TTL from when it was unwrapped, however often
+// it's used, and zeroed when its entry expires, is evicted or purged.
+type CachedIdentity struct {
+	id         Identity
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+	byAge   *list.List // of *list.Element of lru, oldest at the front
+}
+
+// NewCachedIdentity returns a CachedIdentity keeping up to maxEntries file
+// keys unwrapped by id, each for ttl after it was unwrapped. When full, the
+// least recently used entry is evicted. If maxEntries is less than one, the
+// number of entries is not limited.
+func NewCachedIdentity(id Identity, ttl time.Duration, maxEntries int) *CachedIdentity {
+	return &CachedIdentity{
+		id:         id,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		entries:    make(map[[sha256.Size]byte]*list.Element),
+		lru:        list.New(),
+		byAge:      list.New(),
+	}
+}
+
+func stanzasHash(stanzas []*Stanza) [sha256.Size]byte {
+	h := sha256.New()
+	for _, s := range stanzas {
+		_ = (*format.Stanza)(s).Marshal(h)
+	}
+
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+
+	return sum
+}
+
+// Unwrap returns the cached file key for stanzas, or unwraps it with the
+// wrapped Identity and caches it on success.
+func (c *CachedIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	hash := stanzasHash(stanzas)
+
+	if fileKey := c.get(hash); fileKey != nil {
+		return fileKey, nil
+	}
+
+	fileKey, err := c.id.Unwrap(stanzas)
+	if err != nil {
+		return nil, err
+	}
+
+	c.put(hash, fileKey)
+
+	return fileKey, nil
+}
+
+// get returns a copy of the file key cached for hash, if any.
+func (c *CachedIdentity) get(hash [sha256.Size]byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire()
+
+	e, ok := c.entries[hash]
+	if !ok {
+		return nil
+	}
+
+	entry := e.Value.(*cacheEntry)
+	c.lru.MoveToFront(e)
+
+	return append([]byte{}, entry.fileKey...)
+}
+
+func (c *CachedIdentity) put(hash [sha256.Size]byte, fileKey []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[hash]; ok {
+		c.remove(e)
+	}
+
+	e := c.lru.PushFront(&cacheEntry{
+		hash:    hash,
+		fileKey: append([]byte{}, fileKey...),
+		expires: c.now().Add(c.ttl),
+	})
+	e.Value.(*cacheEntry).byAge = c.byAge.PushBack(e)
+	c.entries[hash] = e
+
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// expire removes the expired entries, which are the oldest ones.
+func (c *CachedIdentity) expire() {
+	now := c.now()
+
+	for a := c.byAge.Front(); a != nil; a = c.byAge.Front() {
+		e := a.Value.(*list.Element)
+		if now.Before(e.Value.(*cacheEntry).expires) {
+			break
+		}
+		c.remove(e)
+	}
+}
+
+func (c *CachedIdentity) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	c.byAge.Remove(entry.byAge)
+	delete(c.entries, entry.hash)
+	zero(entry.fileKey)
+}
+
+// Len returns the number of file keys in the cache, including expired ones
+// not removed yet.
+func (c *CachedIdentity) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// Purge removes and zeroes all the cached file keys.
+func (c *CachedIdentity) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
@@ -0,0 +1,127 @@
+package age
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingIdentity struct {
+	Identity
+	calls int32
+}
+
+func (c *countingIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	atomic.AddInt32(&c.calls, 1)
+
+	return c.Identity.Unwrap(stanzas)
+}
+
+func TestCachedIdentity(t *testing.T) {
+	files := [][]byte{encryptString(t, "one"), encryptString(t, "two"), encryptString(t, "three")}
+
+	counting := &countingIdentity{Identity: ident}
+	cached := NewCachedIdentity(counting, time.Minute, 2)
+
+	now := time.Now()
+	cached.now = func() time.Time { return now }
+
+	decrypt := func(file []byte) string {
+		r, err := DecryptN(bytes.NewReader(file), 1, cached)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return string(data)
+	}
+
+	for i := 0; i < 3; i++ {
+		if decrypt(files[0]) != "one" || decrypt(files[1]) != "two" {
+			t.Fatalf("plaintext mismatch")
+		}
+	}
+	if counting.calls != 2 {
+		t.Fatalf("expected 2 unwraps, got %d", counting.calls)
+	}
+
+	// The least recently used entry is evicted.
+	decrypt(files[2])
+	decrypt(files[1])
+	decrypt(files[0])
+	if counting.calls != 4 || cached.Len() != 2 {
+		t.Fatalf("expected 4 unwraps and 2 entries, got %d and %d", counting.calls, cached.Len())
+	}
+
+	// Entries expire.
+	now = now.Add(2 * time.Minute)
+	decrypt(files[0])
+	if counting.calls != 5 || cached.Len() != 1 {
+		t.Fatalf("expected 5 unwraps and 1 entry, got %d and %d", counting.calls, cached.Len())
+	}
+
+	// Purge zeroes the file keys.
+	entry := cached.lru.Front().Value.(*cacheEntry)
+	cached.Purge()
+	if cached.Len() != 0 || !bytes.Equal(entry.fileKey, make([]byte, len(entry.fileKey))) {
+		t.Fatalf("expected an empty cache with zeroed keys")
+	}
+
+	decrypt(files[0])
+	if counting.calls != 6 {
+		t.Fatalf("expected 6 unwraps, got %d", counting.calls)
+	}
+}
+
+func TestCachedIdentityErrors(t *testing.T) {
+	file := encryptString(t, "hello")
+
+	other, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	counting := &countingIdentity{Identity: other}
+	cached := NewCachedIdentity(counting, time.Minute, 0)
+
+	for i := 0; i < 2; i++ {
+		_, err = DecryptN(bytes.NewReader(file), 1, cached)
+		var noMatch *NoIdentityMatchError
+		if !errors.As(err, &noMatch) {
+			t.Fatalf("expected a NoIdentityMatchError, got %v", err)
+		}
+	}
+
+	// Errors are not cached.
+	if counting.calls != 2 || cached.Len() != 0 {
+		t.Fatalf("expected 2 unwraps and no entries, got %d and %d", counting.calls, cached.Len())
+	}
+}
+
+func TestCachedIdentityTTL(t *testing.T) {
+	file := encryptString(t, "hello")
+
+	counting := &countingIdentity{Identity: ident}
+	cached := NewCachedIdentity(counting, time.Minute, 0)
+
+	now := time.Now()
+	cached.now = func() time.Time { return now }
+
+	// Using a key doesn't extend its TTL.
+	for i := 0; i < 4; i++ {
+		if _, err := DecryptN(bytes.NewReader(file), 1, cached); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		now = now.Add(20 * time.Second)
+	}
+	if counting.calls != 2 {
+		t.Fatalf("expected 2 unwraps, got %d", counting.calls)
+	}
+}
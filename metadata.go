@@ -0,0 +1,212 @@
+package age
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bifrosta/age-concurrent/internal/format"
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+// Metadata describes how a file was decrypted, for example for audit logs.
+type Metadata struct {
+	// IdentityIndex is the index of the identity that unwrapped the file key,
+	// among the identities passed to DecryptWithMetadata.
+	IdentityIndex int
+
+	// IdentityType is the Go type of that identity, such as
+	// "*age.X25519Identity".
+	IdentityType string
+
+	// StanzaIndex is the index of the recipient stanza the identity matched.
+	// It's only -1 for invalid headers mixing a scrypt stanza with others.
+	StanzaIndex int
+
+	// StanzaType and StanzaArgs are the type and arguments of that stanza.
+	StanzaType string
+	StanzaArgs []string
+
+	// Stanzas is the number of stanzas in the header, including metadata
+	// stanzas.
+	Stanzas int
+
+	// Extra holds the metadata stanzas of the header, whose type starts with
+	// "x-", in order. They are authenticated by the header MAC.
+	Extra []*Stanza
+
+	// HeaderSize is the size of the header in bytes, including the MAC line.
+	HeaderSize int64
+
+	// Nonce is the payload nonce following the header.
+	Nonce []byte
+}
+
+// DecryptWithMetadata is like Decrypt, but also returns a description of how
+// the file was decrypted.
+func DecryptWithMetadata(src io.Reader, identities ...Identity) (io.Reader, *Metadata, error) {
+	return DecryptWithMetadataN(src, 0, identities...)
+}
+
+// DecryptWithMetadataN is like DecryptN, but also returns a description of how
+// the file was decrypted.
+//
+// To find the matching stanza, every identity is passed the stanzas one at a
+// time, in order, until one matches, rather than all of them in a single
+// Unwrap call. This is what X25519 identities do anyway, but a plugin is
+// started once per call, and a CachedIdentity caches the file key under the
+// matching stanza alone, so it isn't shared with DecryptN. Wrapping
+// identities, such as ConcurrentIdentities, are reported as a whole.
+//
+// Headers with a scrypt stanza are passed whole, since it must be the only
+// stanza, and StanzaIndex is -1 if there are others.
+func DecryptWithMetadataN(src io.Reader, concurrent int, identities ...Identity) (io.Reader, *Metadata, error) {
+	if len(identities) == 0 {
+		return nil, nil, errors.New("no identities specified")
+	}
+
+	hdr, payload, err := format.Parse(src)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	recorders := make([]*stanzaRecorder, len(identities))
+	wrapped := make([]Identity, len(identities))
+	for i, id := range identities {
+		recorders[i] = &stanzaRecorder{id: id, index: -1}
+		wrapped[i] = recorders[i]
+	}
+
+	fileKey, index, err := unwrapFileKeyIndex(hdr, wrapped)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce, err := readNonce(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := stream.NewPayloadReader(streamKey(fileKey, nonce), payload, concurrent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stanzas := headerStanzas(hdr)
+
+	m := &Metadata{
+		IdentityIndex: index,
+		IdentityType:  fmt.Sprintf("%T", identities[index]),
+		StanzaIndex:   recorders[index].index,
+		Stanzas:       len(stanzas),
+		HeaderSize:    headerSize(hdr),
+		Nonce:         nonce,
+	}
+	for _, s := range stanzas {
+		if strings.HasPrefix(s.Type, metadataPrefix) {
+			m.Extra = append(m.Extra, copyStanza(s))
+		}
+	}
+	if m.StanzaIndex >= 0 {
+		s := stanzas[m.StanzaIndex]
+		m.StanzaType = s.Type
+		m.StanzaArgs = append([]string{}, s.Args...)
+	}
+
+	return r, m, nil
+}
+
+// stanzaRecorder passes the stanzas to an identity one at a time, in order,
+// recording the index of the stanza that matched.
+type stanzaRecorder struct {
+	id    Identity
+	index int
+}
+
+func (r *stanzaRecorder) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	if len(stanzas) == 1 || hasScryptStanza(stanzas) {
+		// A scrypt stanza must be the only one, which a ScryptIdentity can
+		// only check when passed all the stanzas.
+		fileKey, err := r.id.Unwrap(stanzas)
+		if err == nil && len(stanzas) == 1 {
+			r.index = 0
+		}
+
+		return fileKey, err
+	}
+
+	incorrect := ErrIncorrectIdentity
+	for i, s := range stanzas {
+		fileKey, err := r.id.Unwrap([]*Stanza{s})
+		if errors.Is(err, ErrIncorrectIdentity) {
+			if i == 0 {
+				incorrect = err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		r.index = i
+
+		return fileKey, nil
+	}
+
+	return nil, incorrect
+}
+
+func hasScryptStanza(stanzas []*Stanza) bool {
+	for _, s := range stanzas {
+		if s.Type == "scrypt" {
+			return true
+		}
+	}
+
+	return false
+}
+
+const metadataPrefix = "x-"
+
+type metadataRecipient struct {
+	s *Stanza
+}
+
+// MetadataRecipient returns a Recipient adding s to the header, for tags such
+// as a content type, an original filename or a producer ID. Pass it to
+// EncryptN or any other function taking recipients, along with the actual
+// recipients.
+//
+// The type of s must start with "x-", and the type and arguments must be valid
+// stanza strings. The stanza doesn't wrap the file key, but is covered by the
+// header MAC, so once a file key is unwrapped, DecryptWithMetadataN returns it
+// in Metadata.Extra only if it wasn't tampered with. Other age
+// implementations ignore it as an unknown stanza.
+//
+// Like any other recipient without labels, it can't be mixed with recipients
+// that have labels, such as scrypt.
+func MetadataRecipient(s *Stanza) (Recipient, error) {
+	if !strings.HasPrefix(s.Type, metadataPrefix) || !format.IsValidString(s.Type) {
+		return nil, fmt.Errorf("invalid metadata stanza type %q", s.Type)
+	}
+	for _, a := range s.Args {
+		if !format.IsValidString(a) {
+			return nil, fmt.Errorf("invalid metadata stanza argument %q", a)
+		}
+	}
+
+	return &metadataRecipient{s: copyStanza(s)}, nil
+}
+
+func (m *metadataRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	return []*Stanza{copyStanza(m.s)}, nil
+}
+
+func copyStanza(s *Stanza) *Stanza {
+	return &Stanza{
+		Type: s.Type,
+		Args: append([]string{}, s.Args...),
+		Body: append([]byte{}, s.Body...),
+	}
+}
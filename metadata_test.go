@@ -0,0 +1,175 @@
+package age
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	realage "filippo.io/age"
+)
+
+func TestDecryptWithMetadata(t *testing.T) {
+	other, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := Encrypt(buf, recipient2, other.Recipient(), recipient1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := io.WriteString(w, "hello"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	file := buf.Bytes()
+
+	unrelated, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r, m, err := DecryptWithMetadataN(bytes.NewReader(file), 1, unrelated, ident)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("plaintext mismatch (%v)", err)
+	}
+
+	if m.IdentityIndex != 1 || m.IdentityType != "*age.X25519Identity" {
+		t.Errorf("unexpected identity %d (%s)", m.IdentityIndex, m.IdentityType)
+	}
+	if m.StanzaIndex != 2 || m.StanzaType != "X25519" || len(m.StanzaArgs) != 1 || m.Stanzas != 3 {
+		t.Errorf("unexpected stanza %d of %d: %s %v", m.StanzaIndex, m.Stanzas, m.StanzaType, m.StanzaArgs)
+	}
+	if m.HeaderSize <= 0 || !bytes.Equal(file[m.HeaderSize:m.HeaderSize+streamNonceSize], m.Nonce) {
+		t.Errorf("nonce not found after the %d bytes header", m.HeaderSize)
+	}
+
+	// The other identity matches the middle stanza.
+	_, m, err = DecryptWithMetadataN(bytes.NewReader(file), 1, other)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.IdentityIndex != 0 || m.StanzaIndex != 1 {
+		t.Errorf("expected identity 0 and stanza 1, got %d and %d", m.IdentityIndex, m.StanzaIndex)
+	}
+
+	// Wrapping identities are reported as a whole, with the stanza found.
+	_, m, err = DecryptWithMetadataN(bytes.NewReader(file), 1, ConcurrentIdentities(0, unrelated, ident))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.IdentityIndex != 0 || m.IdentityType != "*age.concurrentIdentities" || m.StanzaIndex != 2 || m.StanzaType != "X25519" {
+		t.Errorf("unexpected identity %d (%s) and stanza %d", m.IdentityIndex, m.IdentityType, m.StanzaIndex)
+	}
+
+	// Other identities are called once per stanza until one matches, and
+	// never again.
+	counting := &countingIdentity{Identity: ident}
+	cached := NewCachedIdentity(counting, time.Minute, 0)
+	_, m, err = DecryptWithMetadataN(bytes.NewReader(file), 1, cached)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if counting.calls != 3 || cached.Len() != 1 || m.StanzaIndex != 2 {
+		t.Errorf("expected 3 unwraps, 1 entry and stanza 2, got %d, %d and %d", counting.calls, cached.Len(), m.StanzaIndex)
+	}
+
+	// A scrypt stanza is the only one.
+	passphrase, err := realage.NewScryptRecipient("passphrase")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	passphrase.SetWorkFactor(10)
+	scryptFile := &bytes.Buffer{}
+	w, err = Encrypt(scryptFile, passphrase)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	scrypt, err := realage.NewScryptIdentity("passphrase")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, m, err = DecryptWithMetadataN(bytes.NewReader(scryptFile.Bytes()), 1, ident, scrypt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.IdentityIndex != 1 || m.StanzaIndex != 0 || m.StanzaType != "scrypt" {
+		t.Errorf("unexpected identity %d and stanza %d (%s)", m.IdentityIndex, m.StanzaIndex, m.StanzaType)
+	}
+
+	if _, _, err := DecryptWithMetadataN(bytes.NewReader(file), 1, unrelated); err == nil {
+		t.Fatalf("expected an error with an unrelated identity")
+	}
+}
+
+func TestMetadataRecipient(t *testing.T) {
+	tag, err := MetadataRecipient(&Stanza{
+		Type: "x-meta",
+		Args: []string{"content-type", "application/json"},
+		Body: []byte("report 2024.json"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := EncryptN(buf, 1, tag, recipient1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := io.WriteString(w, "{}"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	file := buf.Bytes()
+
+	_, m, err := DecryptWithMetadataN(bytes.NewReader(file), 1, ident)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.StanzaIndex != 1 || m.Stanzas != 2 || len(m.Extra) != 1 {
+		t.Fatalf("expected stanza 1 of 2 and 1 metadata stanza, got %d of %d and %d", m.StanzaIndex, m.Stanzas, len(m.Extra))
+	}
+	if s := m.Extra[0]; s.Type != "x-meta" || strings.Join(s.Args, " ") != "content-type application/json" || string(s.Body) != "report 2024.json" {
+		t.Errorf("unexpected metadata stanza %s %v %q", s.Type, s.Args, s.Body)
+	}
+
+	// Other implementations ignore the stanza.
+	r, err := realage.Decrypt(bytes.NewReader(file), ident)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, err := io.ReadAll(r); err != nil || string(data) != "{}" {
+		t.Fatalf("plaintext mismatch (%v)", err)
+	}
+
+	// The stanza is covered by the header MAC.
+	tampered := bytes.Replace(file, []byte("application/json"), []byte("application/xml!"), 1)
+	if _, _, err := DecryptWithMetadataN(bytes.NewReader(tampered), 1, ident); err == nil || !strings.Contains(err.Error(), "bad header MAC") {
+		t.Fatalf("expected a bad header MAC, got %v", err)
+	}
+
+	if _, err := MetadataRecipient(&Stanza{Type: "meta"}); err == nil {
+		t.Errorf("expected an error for a type without the x- prefix")
+	}
+	if _, err := MetadataRecipient(&Stanza{Type: "x-meta", Args: []string{"has space"}}); err == nil {
+		t.Errorf("expected an error for an invalid argument")
+	}
+	if _, err := EncryptN(&bytes.Buffer{}, 1, tag); err == nil {
+		t.Errorf("expected an error without actual recipients")
+	}
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package age
+
+import (
+	"errors"
+	"math"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps f into memory read-only. Only non-empty regular files can be
+// mapped.
+func mmapFile(f *os.File) ([]byte, func() error, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !info.Mode().IsRegular() || info.Size() == 0 || info.Size() > math.MaxInt {
+		return nil, nil, errors.New("file can't be memory mapped")
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() error {
+		return syscall.Munmap(data)
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package age
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile is only implemented on Linux, other platforms use the streaming
+// path.
+func mmapFile(f *os.File) ([]byte, func() error, error) {
+	return nil, nil, errors.New("memory mapping is not supported")
+}
@@ -0,0 +1,256 @@
+package age
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// PartUploader receives the parts of an encrypted file, for example through
+// the multipart upload API of an object store.
+type PartUploader interface {
+	// UploadPart uploads part number partNum, counting from 1. It's called
+	// concurrently for different parts, and called again for the same part
+	// after a failure. data must not be retained after it returns.
+	UploadPart(ctx context.Context, partNum int, data []byte) error
+
+	// Complete is called once all the parts have been uploaded.
+	Complete(ctx context.Context, parts int) error
+}
+
+// PartAborter can be optionally implemented by a PartUploader, in which case
+// Abort is called when the upload fails, for example to delete the parts
+// uploaded so far.
+type PartAborter interface {
+	Abort(ctx context.Context) error
+}
+
+// MultipartOptions configures EncryptMultipart. A nil *MultipartOptions uses
+// the defaults.
+type MultipartOptions struct {
+	// Concurrent is the number of concurrent encryption workers. If less than
+	// one, runtime.NumCPU() is used.
+	Concurrent int
+
+	// PartSize is the size of every part but the last, 8 MiB if zero.
+	PartSize int
+
+	// Parallel is the number of parts uploaded concurrently, 4 if zero.
+	Parallel int
+
+	// Retries is the number of times a failed part is retried, 3 if zero.
+	// Use a negative value to disable retries.
+	Retries int
+
+	// Backoff is the delay before the first retry of a part, doubled for
+	// every further retry, 500ms if zero.
+	Backoff time.Duration
+}
+
+// EncryptMultipart encrypts a file to one or more recipients, and uploads it in
+// fixed-size parts through up.
+//
+// Sealed chunks are grouped into parts of opts.PartSize, and up to
+// opts.Parallel parts are uploaded concurrently while encryption continues.
+// Failed parts are retried. If a part still fails, the error is returned by the
+// following Write or by Close, and up is aborted if it implements PartAborter.
+//
+// The caller must call Close on the WriteCloser when done for the last part to
+// be uploaded and the upload to be completed.
+func EncryptMultipart(ctx context.Context, up PartUploader, opts *MultipartOptions, recipients ...Recipient) (io.WriteCloser, error) {
+	if opts == nil {
+		opts = &MultipartOptions{}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	m := &multipartWriter{
+		ctx:     ctx,
+		cancel:  cancel,
+		up:      up,
+		retries: opts.Retries,
+		backoff: opts.Backoff,
+	}
+
+	partSize := opts.PartSize
+	if partSize < 1 {
+		partSize = 8 * 1024 * 1024
+	}
+
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = 4
+	}
+
+	if m.retries == 0 {
+		m.retries = 3
+	}
+	if m.backoff == 0 {
+		m.backoff = 500 * time.Millisecond
+	}
+
+	// One buffer is being filled while the others are uploaded.
+	m.bufs = make(chan []byte, parallel)
+	for i := 0; i < parallel; i++ {
+		m.bufs <- make([]byte, 0, partSize)
+	}
+	m.buf = make([]byte, 0, partSize)
+
+	w, err := EncryptN(m, opts.Concurrent, recipients...)
+	if err != nil {
+		cancel()
+
+		return nil, err
+	}
+
+	return &multipartUpload{w: w, m: m}, nil
+}
+
+type multipartUpload struct {
+	w io.WriteCloser
+	m *multipartWriter
+}
+
+func (u *multipartUpload) Write(p []byte) (int, error) {
+	return u.w.Write(p)
+}
+
+func (u *multipartUpload) Close() error {
+	err := u.w.Close()
+	if err == nil {
+		err = u.m.finish()
+	}
+
+	if err != nil {
+		u.m.abort()
+	}
+	u.m.cancel()
+
+	return err
+}
+
+// multipartWriter groups the encrypted file into parts and uploads them. Write
+// is never called concurrently: EncryptN writes the header from the caller's
+// goroutine before starting the stream Writer, whose output goroutine makes
+// all the later calls.
+type multipartWriter struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	up      PartUploader
+	retries int
+	backoff time.Duration
+
+	buf  []byte
+	bufs chan []byte
+	part int
+	wg   sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+func (m *multipartWriter) error() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.err
+}
+
+func (m *multipartWriter) setError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err == nil {
+		m.err = err
+	}
+}
+
+func (m *multipartWriter) Write(p []byte) (int, error) {
+	total := len(p)
+
+	for len(p) > 0 {
+		if err := m.error(); err != nil {
+			return total - len(p), err
+		}
+
+		n := copy(m.buf[len(m.buf):cap(m.buf)], p)
+		m.buf = m.buf[:len(m.buf)+n]
+		p = p[n:]
+
+		if len(m.buf) == cap(m.buf) {
+			m.flush()
+		}
+	}
+
+	return total, nil
+}
+
+// flush starts uploading the current part, and waits for a free buffer when
+// all parallel uploads are busy.
+func (m *multipartWriter) flush() {
+	m.part++
+
+	m.wg.Add(1)
+	go func(part int, buf []byte) {
+		defer m.wg.Done()
+
+		err := m.upload(part, buf)
+		if err != nil {
+			m.setError(err)
+			m.cancel()
+		}
+
+		m.bufs <- buf[:0]
+	}(m.part, m.buf)
+
+	m.buf = <-m.bufs
+}
+
+func (m *multipartWriter) upload(part int, data []byte) error {
+	backoff := m.backoff
+
+	for attempt := 0; ; attempt++ {
+		err := m.up.UploadPart(m.ctx, part, data)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= m.retries || m.ctx.Err() != nil {
+			return fmt.Errorf("failed to upload part %d: %w", part, err)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-m.ctx.Done():
+			return fmt.Errorf("failed to upload part %d: %w", part, err)
+		}
+		backoff *= 2
+	}
+}
+
+// finish uploads the last part and completes the upload.
+func (m *multipartWriter) finish() error {
+	if len(m.buf) > 0 {
+		m.flush()
+	}
+
+	m.wg.Wait()
+
+	err := m.error()
+	if err != nil {
+		return err
+	}
+
+	return m.up.Complete(m.ctx, m.part)
+}
+
+func (m *multipartWriter) abort() {
+	m.wg.Wait()
+
+	if a, ok := m.up.(PartAborter); ok {
+		// The upload context may already be canceled.
+		_ = a.Abort(context.Background())
+	}
+}
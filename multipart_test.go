@@ -0,0 +1,173 @@
+package age
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	realage "filippo.io/age"
+)
+
+type fakeUploader struct {
+	mu        sync.Mutex
+	parts     map[int][]byte
+	failures  map[int]int
+	completed int
+	aborted   bool
+}
+
+func newFakeUploader() *fakeUploader {
+	return &fakeUploader{
+		parts:    make(map[int][]byte),
+		failures: make(map[int]int),
+	}
+}
+
+func (f *fakeUploader) UploadPart(ctx context.Context, partNum int, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failures[partNum] != 0 {
+		f.failures[partNum]--
+
+		return errors.New("upload error")
+	}
+
+	f.parts[partNum] = append([]byte{}, data...)
+
+	return nil
+}
+
+func (f *fakeUploader) Complete(ctx context.Context, parts int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.completed = parts
+
+	return nil
+}
+
+func (f *fakeUploader) Abort(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.aborted = true
+
+	return nil
+}
+
+func (f *fakeUploader) Bytes() []byte {
+	buf := bytes.NewBuffer(nil)
+	for i := 1; i <= len(f.parts); i++ {
+		buf.Write(f.parts[i])
+	}
+
+	return buf.Bytes()
+}
+
+func TestEncryptMultipart(t *testing.T) {
+	for _, l := range []int{0, 1000, 64 * 1024, 1024 * 1024, 5*1024*1024 + 1} {
+		t.Run(fmt.Sprintf("%d", l), func(t *testing.T) {
+			up := newFakeUploader()
+			// Some parts fail before succeeding.
+			up.failures[1] = 2
+			up.failures[3] = 1
+
+			opts := &MultipartOptions{
+				PartSize: 256 * 1024,
+				Parallel: 3,
+				Backoff:  time.Millisecond,
+			}
+
+			w, err := EncryptMultipart(context.Background(), up, opts, recipient1)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			test := []byte(genString(l))
+
+			_, err = w.Write(test)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			err = w.Close()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if up.completed != len(up.parts) || up.aborted {
+				t.Fatalf("unexpected state: %d parts, %d completed, aborted %v", len(up.parts), up.completed, up.aborted)
+			}
+
+			for i := 1; i < len(up.parts); i++ {
+				if len(up.parts[i]) != opts.PartSize {
+					t.Fatalf("unexpected size of part %d: %d", i, len(up.parts[i]))
+				}
+			}
+
+			r, err := realage.Decrypt(bytes.NewReader(up.Bytes()), ident)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			out, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(out, test) {
+				t.Fatalf("unexpected output")
+			}
+		})
+	}
+}
+
+func TestEncryptMultipartFailure(t *testing.T) {
+	up := newFakeUploader()
+	up.failures[2] = 100
+
+	opts := &MultipartOptions{
+		PartSize: 64 * 1024,
+		Parallel: 2,
+		Retries:  2,
+		Backoff:  time.Millisecond,
+	}
+
+	w, err := EncryptMultipart(context.Background(), up, opts, recipient1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	buf := make([]byte, 64*1024)
+	for i := 0; i < 100 && err == nil; i++ {
+		_, err = w.Write(buf)
+	}
+
+	cerr := w.Close()
+	if cerr == nil {
+		t.Fatalf("expected error, got nil")
+	}
+
+	if err != nil && err.Error() != cerr.Error() {
+		t.Errorf("different errors from Write and Close: %v, %v", err, cerr)
+	}
+
+	if cerr.Error() != "failed to upload part 2: upload error" {
+		t.Errorf("unexpected error: %v", cerr)
+	}
+
+	// The first attempt and two retries.
+	if up.failures[2] != 97 {
+		t.Errorf("unexpected number of attempts: %d", 100-up.failures[2])
+	}
+
+	if !up.aborted || up.completed != 0 {
+		t.Errorf("upload was not aborted")
+	}
+}
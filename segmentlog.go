@@ -0,0 +1,426 @@
+package age
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentPrefix = "segment-"
+	segmentMagic  = "agelog01"
+
+	// segmentPreambleSize is the size of the magic and sequence number at
+	// the start of the plaintext of every segment.
+	segmentPreambleSize = len(segmentMagic) + 8
+)
+
+// LogOptions configures a LogWriter or LogReader. A nil *LogOptions uses the
+// defaults.
+type LogOptions struct {
+	// Concurrent is the number of concurrent workers. If less than one,
+	// runtime.NumCPU() is used.
+	Concurrent int
+
+	// MaxSize is the plaintext size after which a new segment is started,
+	// 64 MiB if zero. A single Write is never split across segments, so a
+	// segment can exceed it by the size of its last Write.
+	MaxSize int64
+
+	// MaxAge, if not zero, is the time after which a segment is closed, even
+	// if nothing is written to it anymore.
+	MaxAge time.Duration
+}
+
+func (o *LogOptions) maxSize() int64 {
+	if o == nil || o.MaxSize < 1 {
+		return 64 << 20
+	}
+
+	return o.MaxSize
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%s%016d.age", segmentPrefix, seq)
+}
+
+// parseSegmentName returns the sequence number of a segment file name.
+func parseSegmentName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, encryptedExt) {
+		return 0, false
+	}
+
+	seq, err := strconv.ParseUint(name[len(segmentPrefix):len(name)-len(encryptedExt)], 10, 64)
+	if err != nil || segmentName(seq) != name {
+		return 0, false
+	}
+
+	return seq, true
+}
+
+// listSegments returns the sequence numbers of the segments in dir, sorted.
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []uint64
+	for _, e := range entries {
+		if seq, ok := parseSegmentName(e.Name()); ok && e.Type().IsRegular() {
+			seqs = append(seqs, seq)
+		}
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	return seqs, nil
+}
+
+// LogWriter writes a log as a directory of segments, each of them an
+// independent age file, so that log entries are never stored unencrypted.
+// A LogWriter is safe for concurrent use.
+//
+// Segments are named segment-<sequence number>.age, and the sequence number
+// is also encrypted at the start of their plaintext, so that a LogReader can
+// detect segments that were deleted, renamed or reordered. Every segment is
+// written to a temporary file, and only appears under its name once it has
+// been closed and authenticates on its own.
+//
+// Entries never reach the disk unencrypted: every 64 KiB chunk is written to
+// the temporary file of the segment once sealed, while the last, partial
+// chunk is held unencrypted in memory. If the process exits without calling
+// Close, the temporary file is left unpublished, and its entries are lost to
+// a LogReader. MaxAge bounds how long that can be.
+type LogWriter struct {
+	dir        string
+	recipients []Recipient
+	concurrent int
+	maxSize    int64
+	maxAge     time.Duration
+
+	mu      sync.Mutex
+	seq     uint64
+	file    *atomicFile
+	w       io.WriteCloser
+	written int64
+	timer   *time.Timer
+	err     error
+}
+
+// OpenLogWriter returns a LogWriter writing segments encrypted to one or more
+// recipients into dir, which is created if needed. If dir already holds
+// segments, the log continues after the last one.
+func OpenLogWriter(dir string, opts *LogOptions, recipients ...Recipient) (*LogWriter, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients specified")
+	}
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	seqs, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &LogWriter{
+		dir:        dir,
+		recipients: recipients,
+		maxSize:    opts.maxSize(),
+	}
+	if opts != nil {
+		l.concurrent = opts.Concurrent
+		l.maxAge = opts.MaxAge
+	}
+	if len(seqs) > 0 {
+		l.seq = seqs[len(seqs)-1] + 1
+	}
+
+	return l, nil
+}
+
+// open starts a new segment.
+func (l *LogWriter) open() error {
+	f, err := createAtomic(filepath.Join(l.dir, segmentName(l.seq)))
+	if err != nil {
+		return err
+	}
+
+	w, err := EncryptN(f, l.concurrent, l.recipients...)
+	if err != nil {
+		f.Abort()
+
+		return err
+	}
+
+	preamble := make([]byte, segmentPreambleSize)
+	copy(preamble, segmentMagic)
+	binary.BigEndian.PutUint64(preamble[len(segmentMagic):], l.seq)
+
+	_, err = w.Write(preamble)
+	if err != nil {
+		abort(w)
+		f.Abort()
+
+		return err
+	}
+
+	l.file = f
+	l.w = w
+	l.written = 0
+
+	if l.maxAge > 0 {
+		seq := l.seq
+		l.timer = time.AfterFunc(l.maxAge, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			// The segment may have been closed in the meantime.
+			if l.w != nil && l.seq == seq && l.err == nil {
+				l.err = l.close()
+			}
+		})
+	}
+
+	return nil
+}
+
+// close finishes the current segment, if any.
+func (l *LogWriter) close() error {
+	if l.w == nil {
+		return nil
+	}
+
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+
+	err := l.w.Close()
+	if err == nil {
+		err = l.file.Close()
+	} else {
+		l.file.Abort()
+	}
+
+	l.w = nil
+	l.file = nil
+	l.seq++
+
+	return err
+}
+
+// Write writes p to the current segment, starting a new one first if p would
+// make it exceed MaxSize.
+func (l *LogWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil {
+		return 0, l.err
+	}
+
+	if l.w != nil && l.written > 0 && l.written+int64(len(p)) > l.maxSize {
+		l.err = l.close()
+	}
+	if l.err == nil && l.w == nil {
+		l.err = l.open()
+	}
+	if l.err != nil {
+		return 0, l.err
+	}
+
+	n, err := l.w.Write(p)
+	l.written += int64(n)
+	if err != nil {
+		l.err = err
+	}
+
+	return n, err
+}
+
+// Rotate closes the current segment, if anything was written to it. The next
+// Write starts a new one.
+func (l *LogWriter) Rotate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil {
+		return l.err
+	}
+
+	l.err = l.close()
+
+	return l.err
+}
+
+// Close closes the current segment. Further writes fail.
+func (l *LogWriter) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil {
+		if l.w != nil {
+			if l.timer != nil {
+				l.timer.Stop()
+			}
+			abort(l.w)
+			l.file.Abort()
+			l.w = nil
+		}
+
+		return l.err
+	}
+
+	err := l.close()
+	l.err = os.ErrClosed
+
+	return err
+}
+
+// LogReader reads the log written by a LogWriter, decrypting its segments in
+// order.
+type LogReader struct {
+	dir        string
+	identities []Identity
+	concurrent int
+
+	seqs []uint64
+	next int
+	file *os.File
+	r    io.Reader
+	err  error
+}
+
+// OpenLogReader returns a LogReader decrypting the segments in dir with one
+// or more identities.
+//
+// The segments must have consecutive sequence numbers. A missing segment
+// fails OpenLogReader, while a segment renamed to another sequence number
+// fails Read when it's reached. The log may start after the first segment
+// ever written, so that old segments can be removed, and segments removed
+// from its end can't be detected.
+func OpenLogReader(dir string, opts *LogOptions, identities ...Identity) (*LogReader, error) {
+	seqs, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 1; i < len(seqs); i++ {
+		if seqs[i] != seqs[i-1]+1 {
+			return nil, fmt.Errorf("%s: segment %d is missing, but segment %d exists",
+				dir, seqs[i-1]+1, seqs[i])
+		}
+	}
+
+	r := &LogReader{
+		dir:        dir,
+		identities: identities,
+		seqs:       seqs,
+	}
+	if opts != nil {
+		r.concurrent = opts.Concurrent
+	}
+
+	return r, nil
+}
+
+// Segments returns the sequence numbers of the segments, in order.
+func (r *LogReader) Segments() []uint64 {
+	return r.seqs
+}
+
+// openNext opens the next segment and checks its preamble.
+func (r *LogReader) openNext() error {
+	seq := r.seqs[r.next]
+	r.next++
+
+	path := filepath.Join(r.dir, segmentName(seq))
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	r.file = f
+
+	dr, err := DecryptN(f, r.concurrent, r.identities...)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	preamble := make([]byte, segmentPreambleSize)
+	_, err = io.ReadFull(dr, preamble)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == nil && string(preamble[:len(segmentMagic)]) != segmentMagic {
+		return fmt.Errorf("%s: not a log segment", path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	if actual := binary.BigEndian.Uint64(preamble[len(segmentMagic):]); actual != seq {
+		return fmt.Errorf("%s: holds segment %d, it was renamed or reordered", path, actual)
+	}
+
+	r.r = dr
+
+	return nil
+}
+
+// Read reads the decrypted log entries, segment after segment.
+func (r *LogReader) Read(p []byte) (int, error) {
+	for r.err == nil {
+		if r.r == nil {
+			if r.next == len(r.seqs) {
+				r.err = io.EOF
+
+				break
+			}
+
+			r.err = r.openNext()
+
+			continue
+		}
+
+		n, err := r.r.Read(p)
+		if err == io.EOF {
+			r.file.Close()
+			r.file = nil
+			r.r = nil
+			err = nil
+		}
+		if err != nil {
+			r.err = fmt.Errorf("%s: %w", filepath.Join(r.dir, segmentName(r.seqs[r.next-1])), err)
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+
+	return 0, r.err
+}
+
+// Close closes the segment being read.
+func (r *LogReader) Close() error {
+	if r.err == nil {
+		r.err = os.ErrClosed
+	}
+	if r.file != nil {
+		err := r.file.Close()
+		r.file = nil
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package age
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeLog(t testing.TB, dir string, opts *LogOptions, lines []string) {
+	l, err := OpenLogWriter(dir, opts, recipient1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, line := range lines {
+		_, err = io.WriteString(l, line)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	err = l.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func readLog(dir string) (string, error) {
+	r, err := OpenLogReader(dir, nil, ident)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+
+	return string(data), err
+}
+
+func TestLog(t *testing.T) {
+	dir := t.TempDir()
+
+	var lines []string
+	for i := 0; i < 200; i++ {
+		lines = append(lines, fmt.Sprintf("entry %d %s\n", i, genString(i*10)))
+	}
+
+	writeLog(t, dir, &LogOptions{MaxSize: 20000}, lines[:100])
+	// Reopening continues the log.
+	writeLog(t, dir, &LogOptions{MaxSize: 20000}, lines[100:])
+
+	r, err := OpenLogReader(dir, nil, ident)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	if len(r.Segments()) < 10 {
+		t.Fatalf("expected the log to roll, got %d segments", len(r.Segments()))
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(data) != strings.Join(lines, "") {
+		t.Fatalf("plaintext mismatch")
+	}
+
+	// Every segment is a complete age file, and writes are not split.
+	for _, seq := range r.Segments() {
+		f, err := os.Open(filepath.Join(dir, segmentName(seq)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		dr, err := Decrypt(f, ident)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		data, err := io.ReadAll(dr)
+		f.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !strings.HasSuffix(string(data), "\n") {
+			t.Fatalf("segment %d ends in the middle of an entry", seq)
+		}
+	}
+}
+
+func TestLogMaxAge(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := OpenLogWriter(dir, &LogOptions{MaxAge: 10 * time.Millisecond}, recipient1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+
+	_, err = io.WriteString(l, "hello\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The segment is published without further writes.
+	for i := 0; ; i++ {
+		plaintext, err := readLog(dir)
+		if err == nil && plaintext == "hello\n" {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("the segment was not closed (%v)", err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLogErrors(t *testing.T) {
+	setup := func(t *testing.T) string {
+		dir := t.TempDir()
+
+		l, err := OpenLogWriter(dir, nil, recipient1)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(l, "segment %d\n", i)
+			err = l.Rotate()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		l.Close()
+
+		return dir
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		dir := setup(t)
+
+		os.Remove(filepath.Join(dir, segmentName(2)))
+
+		_, err := readLog(dir)
+		if err == nil || !strings.Contains(err.Error(), "segment 2 is missing") {
+			t.Fatalf("expected a missing segment error, got %v", err)
+		}
+	})
+
+	t.Run("reordered", func(t *testing.T) {
+		dir := setup(t)
+
+		tmp := filepath.Join(dir, "tmp")
+		os.Rename(filepath.Join(dir, segmentName(1)), tmp)
+		os.Rename(filepath.Join(dir, segmentName(3)), filepath.Join(dir, segmentName(1)))
+		os.Rename(tmp, filepath.Join(dir, segmentName(3)))
+
+		plaintext, err := readLog(dir)
+		if err == nil || !strings.Contains(err.Error(), "holds segment 3") {
+			t.Fatalf("expected a reordered segment error, got %v", err)
+		}
+		if plaintext != "segment 0\n" {
+			t.Fatalf("unexpected plaintext %q", plaintext)
+		}
+	})
+
+	t.Run("pruned", func(t *testing.T) {
+		dir := setup(t)
+
+		os.Remove(filepath.Join(dir, segmentName(0)))
+		os.Remove(filepath.Join(dir, segmentName(1)))
+
+		plaintext, err := readLog(dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if plaintext != "segment 2\nsegment 3\nsegment 4\n" {
+			t.Fatalf("unexpected plaintext %q", plaintext)
+		}
+	})
+}
+
+func TestLogWriteError(t *testing.T) {
+	dir := t.TempDir()
+	before := runtime.NumGoroutine()
+
+	l, err := OpenLogWriter(dir, &LogOptions{Concurrent: 2}, recipient1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := l.Write([]byte("first\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Writes to the segment fail once its file is closed under the writer.
+	l.file.File.Close()
+
+	chunk := make([]byte, 64*1024)
+	for i := 0; i < 100 && err == nil; i++ {
+		_, err = l.Write(chunk)
+	}
+	if err == nil {
+		t.Fatalf("expected a write error")
+	}
+
+	if err := l.Close(); err == nil {
+		t.Fatalf("expected the write error from Close")
+	}
+
+	waitGoroutines(t, before)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("unexpected files left behind: %v", entries)
+	}
+}
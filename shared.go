@@ -0,0 +1,80 @@
+package age
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+// EncryptShared encrypts a file once under a single file key, and returns a
+// header for every audience, each wrapping the file key to its own recipients.
+//
+// Writes to the returned WriteCloser are encrypted and written to payload,
+// which receives the payload nonce and the encrypted chunks shared by all the
+// audiences. Combine reassembles the age file of an audience from its header
+// and the payload. The caller must call Close on the WriteCloser when done for
+// the last chunk to be encrypted and flushed to payload.
+//
+// As all the audiences share the file key, any of them can decrypt the
+// payload, and could replace it for the others.
+//
+// This will use runtime.NumCPU() as the number of concurrent workers.
+func EncryptShared(payload io.Writer, audiences ...[]Recipient) ([][]byte, io.WriteCloser, error) {
+	return EncryptSharedN(payload, 0, audiences...)
+}
+
+// EncryptSharedN encrypts a file once under a single file key, and returns a
+// header for every audience.
+//
+// It behaves like EncryptShared, but allows the caller to specify the number
+// of concurrent workers to use.
+func EncryptSharedN(payload io.Writer, concurrent int, audiences ...[]Recipient) ([][]byte, io.WriteCloser, error) {
+	if len(audiences) == 0 {
+		return nil, nil, errors.New("no audiences specified")
+	}
+
+	fileKey := make([]byte, fileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, nil, err
+	}
+
+	headers := make([][]byte, 0, len(audiences))
+	for i, recipients := range audiences {
+		hdr, err := wrapHeader(fileKey, recipients)
+		if err != nil {
+			return nil, nil, fmt.Errorf("audience %d: %w", i, err)
+		}
+
+		buf := &bytes.Buffer{}
+		if err := hdr.Marshal(buf); err != nil {
+			return nil, nil, fmt.Errorf("failed to write header: %v", err)
+		}
+		headers = append(headers, buf.Bytes())
+	}
+
+	nonce := make([]byte, streamNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	if _, err := payload.Write(nonce); err != nil {
+		return nil, nil, fmt.Errorf("failed to write nonce: %v", err)
+	}
+
+	w, err := stream.NewPayloadWriter(streamKey(fileKey, nonce), payload, concurrent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return headers, w, nil
+}
+
+// Combine returns the age file made of one of the headers returned by
+// EncryptShared and the shared payload. It can be decrypted by any age
+// implementation.
+func Combine(header []byte, payload io.Reader) io.Reader {
+	return io.MultiReader(bytes.NewReader(header), payload)
+}
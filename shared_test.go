@@ -0,0 +1,71 @@
+package age
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	realage "filippo.io/age"
+)
+
+func TestEncryptShared(t *testing.T) {
+	ident2, err := realage.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%d", len(c)), func(t *testing.T) {
+			payload := &bytes.Buffer{}
+
+			headers, w, err := EncryptSharedN(payload, 3, []Recipient{recipient1}, []Recipient{ident2.Recipient()})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			_, err = io.WriteString(w, c)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			err = w.Close()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for i, id := range []Identity{ident, ident2} {
+				r, err := realage.Decrypt(Combine(headers[i], bytes.NewReader(payload.Bytes())), id)
+				if err != nil {
+					t.Fatalf("audience %d: unexpected error: %v", i, err)
+				}
+
+				data, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatalf("audience %d: unexpected error: %v", i, err)
+				}
+				if string(data) != c {
+					t.Fatalf("audience %d: plaintext mismatch", i)
+				}
+			}
+
+			// The header of one audience doesn't open for another.
+			_, err = realage.Decrypt(Combine(headers[1], bytes.NewReader(payload.Bytes())), ident)
+			if err == nil {
+				t.Fatalf("expected an error decrypting with the wrong identity")
+			}
+		})
+	}
+}
+
+func TestEncryptSharedErrors(t *testing.T) {
+	_, _, err := EncryptShared(io.Discard)
+	if err == nil {
+		t.Fatalf("expected an error without audiences")
+	}
+
+	_, _, err = EncryptShared(io.Discard, []Recipient{recipient1}, nil)
+	if err == nil {
+		t.Fatalf("expected an error for an audience without recipients")
+	}
+}
@@ -0,0 +1,458 @@
+package age
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+// splitProbe is the number of part names checked after the last part found,
+// to tell a missing part from the end of the file.
+const splitProbe = 3
+
+// SplitWriter writes its input to successive part files of a fixed size, for
+// example the ciphertext of EncryptN for targets with a size limit per object.
+// The concatenation of the parts is the original input.
+//
+// Every part is written to a temporary file, which is only renamed to its
+// name once it's complete.
+type SplitWriter struct {
+	partSize int64
+	name     func(part int) string
+
+	part    int
+	cur     *atomicFile
+	written int64
+	err     error
+}
+
+// NewSplitWriter returns a SplitWriter writing parts of partSize bytes, except
+// for the last one. name returns the path of each part, counting from 0.
+func NewSplitWriter(partSize int64, name func(part int) string) (*SplitWriter, error) {
+	if partSize < 1 {
+		return nil, errors.New("part size must be positive")
+	}
+
+	return &SplitWriter{
+		partSize: partSize,
+		name:     name,
+	}, nil
+}
+
+func (w *SplitWriter) next() error {
+	f, err := createAtomic(w.name(w.part))
+	if err != nil {
+		return err
+	}
+
+	w.cur = f
+	w.written = 0
+
+	return nil
+}
+
+func (w *SplitWriter) publish() error {
+	err := w.cur.Close()
+	w.cur = nil
+	if err != nil {
+		return err
+	}
+
+	w.part++
+
+	return nil
+}
+
+// Write writes p, starting a new part whenever the current one is full.
+func (w *SplitWriter) Write(p []byte) (int, error) {
+	total := len(p)
+
+	for len(p) > 0 && w.err == nil {
+		if w.cur == nil {
+			w.err = w.next()
+			if w.err != nil {
+				break
+			}
+		}
+
+		n := int64(len(p))
+		if n > w.partSize-w.written {
+			n = w.partSize - w.written
+		}
+
+		_, w.err = w.cur.Write(p[:n])
+		if w.err != nil {
+			break
+		}
+		w.written += n
+		p = p[n:]
+
+		if w.written == w.partSize {
+			w.err = w.publish()
+		}
+	}
+
+	if w.err != nil {
+		return total - len(p), w.err
+	}
+
+	return total, nil
+}
+
+// Close publishes the last part, and removes the parts following it left by a
+// previous, longer, file written with the same names.
+func (w *SplitWriter) Close() error {
+	if w.err != nil {
+		w.Abort()
+
+		return w.err
+	}
+
+	if w.cur == nil && w.part == 0 {
+		// An empty input is still one empty part.
+		w.err = w.next()
+	}
+	if w.err == nil && w.cur != nil {
+		w.err = w.publish()
+	}
+	if w.err != nil {
+		return w.err
+	}
+	w.err = os.ErrClosed
+
+	for part := w.part; ; part++ {
+		err := os.Remove(w.name(part))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Abort discards the part being written. The parts already complete are left
+// in place.
+func (w *SplitWriter) Abort() {
+	if w.cur != nil {
+		w.cur.Abort()
+		w.cur = nil
+	}
+}
+
+// Parts returns the number of parts written so far.
+func (w *SplitWriter) Parts() int {
+	return w.part
+}
+
+type splitEncryptWriter struct {
+	w     io.WriteCloser
+	split *SplitWriter
+}
+
+func (s *splitEncryptWriter) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+func (s *splitEncryptWriter) Close() error {
+	err := s.w.Close()
+	if err != nil {
+		s.split.Abort()
+
+		return err
+	}
+
+	return s.split.Close()
+}
+
+// EncryptSplit encrypts a file to one or more recipients with EncryptN, and
+// writes the ciphertext to part files of partSize bytes named by name, as
+// NewSplitWriter does. The caller must call Close on the WriteCloser when done.
+func EncryptSplit(partSize int64, name func(part int) string, opts *Options, recipients ...Recipient) (io.WriteCloser, error) {
+	split, err := NewSplitWriter(partSize, name)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := EncryptN(split, opts.concurrent(), recipients...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &splitEncryptWriter{w: w, split: split}, nil
+}
+
+// SplitReader reads the concatenation of the part files written by a
+// SplitWriter, sequentially with Read or concurrently with ReadAt.
+type SplitReader struct {
+	partSize int64
+	name     func(part int) string
+	files    []*os.File
+	size     int64
+	offset   int64
+}
+
+// OpenSplit opens the parts of partSize bytes named by name, counting from 0,
+// until the first one which doesn't exist.
+//
+// It fails if a part following that one exists, as then a part is missing,
+// or if the size of a part shows that it's truncated or out of place.
+func OpenSplit(partSize int64, name func(part int) string) (*SplitReader, error) {
+	if partSize < 1 {
+		return nil, errors.New("part size must be positive")
+	}
+
+	r := &SplitReader{
+		partSize: partSize,
+		name:     name,
+	}
+
+	err := r.open()
+	if err != nil {
+		r.Close()
+
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *SplitReader) open() error {
+	for {
+		f, err := os.Open(r.name(len(r.files)))
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		r.files = append(r.files, f)
+	}
+
+	if len(r.files) == 0 {
+		return &fs.PathError{Op: "open", Path: r.name(0), Err: fs.ErrNotExist}
+	}
+
+	missing := len(r.files)
+	for part := missing + 1; part <= missing+splitProbe; part++ {
+		if _, err := os.Stat(r.name(part)); err == nil {
+			return fmt.Errorf("part %d (%s) is missing, but part %d (%s) exists",
+				missing, r.name(missing), part, r.name(part))
+		}
+	}
+
+	for i, f := range r.files {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		last := i == len(r.files)-1
+		switch {
+		case !last && info.Size() != r.partSize:
+			return fmt.Errorf("part %d (%s) is %d bytes instead of %d: it's truncated, or the parts following it are out of order or extra",
+				i, r.name(i), info.Size(), r.partSize)
+		case last && (info.Size() > r.partSize || info.Size() == 0 && i > 0):
+			return fmt.Errorf("last part %d (%s) is %d bytes, expected 1 to %d",
+				i, r.name(i), info.Size(), r.partSize)
+		}
+
+		r.size += info.Size()
+	}
+
+	return nil
+}
+
+// Size returns the total size of the parts.
+func (r *SplitReader) Size() int64 {
+	return r.size
+}
+
+// Parts returns the number of parts.
+func (r *SplitReader) Parts() int {
+	return len(r.files)
+}
+
+// ReadAt reads len(p) bytes at offset off of the concatenation of the parts.
+// It can be called concurrently.
+func (r *SplitReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	total := 0
+
+	for len(p) > 0 {
+		if off >= r.size {
+			return total, io.EOF
+		}
+
+		part := off / r.partSize
+		partOff := off - part*r.partSize
+
+		n := int64(len(p))
+		if n > r.partSize-partOff {
+			n = r.partSize - partOff
+		}
+
+		read, err := r.files[part].ReadAt(p[:n], partOff)
+		total += read
+		if err != nil && !(err == io.EOF && int64(read) == n) {
+			return total, err
+		}
+
+		p = p[n:]
+		off += n
+	}
+
+	return total, nil
+}
+
+// Read reads the concatenation of the parts sequentially.
+func (r *SplitReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Close closes all the parts.
+func (r *SplitReader) Close() error {
+	var err error
+
+	for _, f := range r.files {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+type splitDecryptReader struct {
+	r            io.Reader
+	split        *SplitReader
+	key          []byte
+	payload      *io.SectionReader
+	payloadStart int64
+}
+
+func (s *splitDecryptReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = s.explain(err)
+	}
+
+	return n, err
+}
+
+// parts returns the parts holding the chunk at the payload offset off.
+func (s *splitDecryptReader) parts(off int64) string {
+	end := off + stream.EncryptedSize(stream.ChunkSize)
+	if end > s.payload.Size() {
+		end = s.payload.Size()
+	}
+
+	first := int((s.payloadStart + off) / s.split.partSize)
+	last := int((s.payloadStart + end - 1) / s.split.partSize)
+	if last >= len(s.split.files) {
+		last = len(s.split.files) - 1
+	}
+	if first > last {
+		first = last
+	}
+
+	if first == last {
+		return fmt.Sprintf("part %d (%s)", first, s.split.name(first))
+	}
+
+	return fmt.Sprintf("parts %d (%s) to %d (%s)", first, s.split.name(first), last, s.split.name(last))
+}
+
+// completeWithout reports whether the payload ending before the last part is
+// a complete file on its own, making the last part extra.
+func (s *splitDecryptReader) completeWithout() bool {
+	last := len(s.split.files) - 1
+	size := int64(last)*s.split.partSize - s.payloadStart
+	if last == 0 || size <= 0 {
+		return false
+	}
+
+	r, err := stream.NewReaderAt(s.key, io.NewSectionReader(s.payload, 0, size), size, 1)
+	if err != nil {
+		return false
+	}
+	if r.Size() == 0 {
+		return true
+	}
+
+	_, err = r.ReadAt(make([]byte, 1), r.Size()-1)
+
+	return err == nil || err == io.EOF
+}
+
+// explain adds the parts in which a chunk failed to err, with the likely
+// reason.
+func (s *splitDecryptReader) explain(err error) error {
+	var chunkErr *stream.ChunkError
+	if !errors.As(err, &chunkErr) {
+		return err
+	}
+
+	r := s.split
+	last := len(r.files) - 1
+
+	if chunkErr.Kind != stream.Truncated && s.completeWithout() {
+		return fmt.Errorf("part %d (%s): the file ends before this part, it's extra: %w", last, r.name(last), err)
+	}
+
+	switch chunkErr.Kind {
+	case stream.AuthFailed:
+		return fmt.Errorf("%s: parts are out of order, or corrupted: %w", s.parts(chunkErr.CiphertextOffset), err)
+	case stream.TrailingData:
+		return fmt.Errorf("%s: data after the end of the file, a part is extra or out of order: %w", s.parts(chunkErr.CiphertextOffset), err)
+	case stream.Truncated:
+		if r.size == int64(len(r.files))*r.partSize {
+			return fmt.Errorf("part %d (%s): the file ends with a full part, parts following it are missing: %w", last, r.name(last), err)
+		}
+
+		return fmt.Errorf("part %d (%s): the file is truncated: %w", last, r.name(last), err)
+	}
+
+	return fmt.Errorf("%s: %w", s.parts(chunkErr.CiphertextOffset), err)
+}
+
+// DecryptSplit decrypts the file made of the parts of r with one or more
+// identities. Like DecryptAtN, every worker reads its own chunks with
+// concurrent ReadAt calls.
+//
+// Chunks failing to authenticate are reported with the part they were read
+// from, and whether the parts look out of order, missing or extra. The
+// underlying *stream.ChunkError is wrapped.
+func DecryptSplit(r *SplitReader, opts *Options, identities ...Identity) (io.Reader, error) {
+	key, payload, err := decryptHeaderAt(r, r.Size(), identities)
+	if err != nil {
+		return nil, fmt.Errorf("part 0 (%s): %w", r.name(0), err)
+	}
+
+	s := &splitDecryptReader{
+		split:        r,
+		key:          key,
+		payload:      payload,
+		payloadStart: r.Size() - payload.Size(),
+	}
+
+	s.r, err = stream.NewPayloadReaderAt(key, payload, payload.Size(), opts.concurrent())
+	if err != nil {
+		return nil, s.explain(err)
+	}
+
+	return s, nil
+}
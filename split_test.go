@@ -0,0 +1,192 @@
+package age
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bifrosta/age-concurrent/stream"
+)
+
+func partNamer(dir string) func(int) string {
+	return func(part int) string {
+		return filepath.Join(dir, fmt.Sprintf("file.age.%03d", part))
+	}
+}
+
+func encryptSplit(t testing.TB, partSize int64, name func(int) string, plaintext string) {
+	w, err := EncryptSplit(partSize, name, &Options{Concurrent: 3}, recipient1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = io.WriteString(w, plaintext)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func decryptSplit(partSize int64, name func(int) string) (string, error) {
+	r, err := OpenSplit(partSize, name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	pr, err := DecryptSplit(r, &Options{Concurrent: 3}, ident)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := io.ReadAll(pr)
+
+	return string(data), err
+}
+
+func TestSplit(t *testing.T) {
+	for _, partSize := range []int64{10000, stream.ChunkSize + 16, 100000} {
+		for _, c := range cases {
+			t.Run(fmt.Sprintf("%d/%d", partSize, len(c)), func(t *testing.T) {
+				name := partNamer(t.TempDir())
+
+				encryptSplit(t, partSize, name, c)
+
+				plaintext, err := decryptSplit(partSize, name)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if plaintext != c {
+					t.Fatalf("plaintext mismatch")
+				}
+
+				// The parts read sequentially are the age file.
+				r, err := OpenSplit(partSize, name)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				defer r.Close()
+
+				dr, err := Decrypt(r, ident)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				data, err := io.ReadAll(dr)
+				if err != nil || string(data) != c {
+					t.Fatalf("plaintext mismatch (%v)", err)
+				}
+			})
+		}
+	}
+}
+
+func TestSplitLeftoverParts(t *testing.T) {
+	name := partNamer(t.TempDir())
+
+	encryptSplit(t, 1000, name, genString(50000))
+	encryptSplit(t, 1000, name, genString(5000))
+
+	plaintext, err := decryptSplit(1000, name)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if plaintext != genString(5000) {
+		t.Fatalf("plaintext mismatch")
+	}
+}
+
+func TestSplitErrors(t *testing.T) {
+	const partSize = 10000
+	plaintext := genString(100000)
+
+	setup := func(t *testing.T) func(int) string {
+		name := partNamer(t.TempDir())
+		encryptSplit(t, partSize, name, plaintext)
+
+		return name
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		name := setup(t)
+
+		os.Remove(name(4))
+
+		_, err := decryptSplit(partSize, name)
+		if err == nil || !strings.Contains(err.Error(), "part 4") || !strings.Contains(err.Error(), "missing") {
+			t.Fatalf("expected a missing part error, got %v", err)
+		}
+	})
+
+	t.Run("missing last", func(t *testing.T) {
+		name := setup(t)
+
+		last := 0
+		for ; ; last++ {
+			if _, err := os.Stat(name(last + 1)); err != nil {
+				break
+			}
+		}
+		os.Remove(name(last))
+
+		_, err := decryptSplit(partSize, name)
+		var chunkErr *stream.ChunkError
+		if !errors.As(err, &chunkErr) || !strings.Contains(err.Error(), "missing") {
+			t.Fatalf("expected a missing part error, got %v", err)
+		}
+	})
+
+	t.Run("reordered", func(t *testing.T) {
+		name := setup(t)
+
+		os.Rename(name(3), name(100))
+		os.Rename(name(5), name(3))
+		os.Rename(name(100), name(5))
+
+		_, err := decryptSplit(partSize, name)
+		var chunkErr *stream.ChunkError
+		if !errors.As(err, &chunkErr) || !strings.Contains(err.Error(), "parts 0") || !strings.Contains(err.Error(), "out of order") {
+			t.Fatalf("expected an out of order error, got %v", err)
+		}
+	})
+
+	t.Run("extra", func(t *testing.T) {
+		name := partNamer(t.TempDir())
+
+		// A file which is exactly one part.
+		buf := &bytes.Buffer{}
+		w, _ := Encrypt(buf, recipient1)
+		io.WriteString(w, plaintext)
+		w.Close()
+
+		encryptSplit(t, int64(buf.Len()), name, plaintext)
+
+		data, _ := os.ReadFile(name(0))
+		os.WriteFile(name(1), data[:100], 0o600)
+
+		_, err := decryptSplit(int64(buf.Len()), name)
+		var chunkErr *stream.ChunkError
+		if !errors.As(err, &chunkErr) || !strings.Contains(err.Error(), "part 1") || !strings.Contains(err.Error(), "extra") {
+			t.Fatalf("expected an extra part error, got %v", err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		name := setup(t)
+
+		os.Truncate(name(2), partSize-1)
+
+		_, err := decryptSplit(partSize, name)
+		if err == nil || !strings.Contains(err.Error(), "part 2") {
+			t.Fatalf("expected a truncated part error, got %v", err)
+		}
+	})
+}
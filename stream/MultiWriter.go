@@ -0,0 +1,228 @@
+package stream
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// plainChunk is a chunk of plaintext shared by the jobs sealing it for every
+// output of a MultiWriter.
+type plainChunk struct {
+	buf     []byte
+	last    bool
+	nonce   [chacha20poly1305.NonceSize]byte
+	pending int32
+}
+
+type multiJob struct {
+	chunk *plainChunk
+	buf   []byte
+	out   *multiOutput
+	res   chan result
+}
+
+// multiOutput is one of the payloads written by a MultiWriter.
+type multiOutput struct {
+	a         cipher.AEAD
+	encrypted chan chan result
+	reBuf     chan []byte
+	reJob     chan *multiJob
+}
+
+// MultiWriter encrypts a single plaintext into several payloads, each with its
+// own key and destination, reading the plaintext once. The chunks of all the
+// payloads are sealed by one shared set of workers.
+type MultiWriter struct {
+	outputs []*multiOutput
+
+	inbuffer []byte
+	fill     int
+	nonce    [chacha20poly1305.NonceSize]byte
+	reIn     chan []byte
+	todo     chan *multiJob
+	done     chan error
+
+	err atomic.Pointer[error]
+}
+
+func (w *MultiWriter) error() error {
+	errPtr := w.err.Load()
+	if errPtr == nil {
+		return nil
+	}
+
+	return *errPtr
+}
+
+// setError records the first error.
+func (w *MultiWriter) setError(err error) {
+	w.err.CompareAndSwap(nil, &err)
+}
+
+// NewMultiPayloadWriter returns a MultiWriter encrypting to every dests[i] with
+// the stream key keys[i], as NewPayloadWriter does for a single destination.
+// concurrent is the number of workers shared by all the destinations.
+func NewMultiPayloadWriter(keys [][]byte, dests []io.Writer, concurrent int) (*MultiWriter, error) {
+	if len(keys) != len(dests) || len(keys) == 0 {
+		return nil, fmt.Errorf("stream: need as many keys as destinations, at least one")
+	}
+
+	if concurrent < 1 {
+		concurrent = runtime.NumCPU()
+	}
+
+	w := &MultiWriter{
+		inbuffer: make([]byte, ChunkSize),
+		reIn:     make(chan []byte, concurrent),
+		todo:     make(chan *multiJob, concurrent),
+		done:     make(chan error, len(dests)),
+	}
+	for i := 0; i < concurrent; i++ {
+		w.reIn <- make([]byte, ChunkSize)
+	}
+
+	for i, key := range keys {
+		a, err := chacha20poly1305.New(key)
+		if err != nil {
+			return nil, err
+		}
+
+		out := &multiOutput{
+			a:         a,
+			encrypted: make(chan chan result, concurrent),
+			reBuf:     make(chan []byte, concurrent),
+			reJob:     make(chan *multiJob, concurrent),
+		}
+		for j := 0; j < concurrent; j++ {
+			out.reBuf <- make([]byte, encChunkSize)
+			out.reJob <- &multiJob{out: out, res: make(chan result, 1)}
+		}
+		w.outputs = append(w.outputs, out)
+
+		go w.writeOutput(out, i, dests[i])
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(concurrent)
+
+	for i := 0; i < concurrent; i++ {
+		go func() {
+			defer wg.Done()
+
+			for j := range w.todo {
+				c := j.chunk
+
+				nonce := c.nonce
+				if c.last {
+					setLastChunkFlag(&nonce)
+				}
+
+				j.res <- result{buf: j.out.a.Seal(j.buf[:0], nonce[:], c.buf, nil)}
+
+				// The last output sealing the chunk releases the plaintext.
+				if atomic.AddInt32(&c.pending, -1) == 0 {
+					w.reIn <- c.buf[:ChunkSize]
+				}
+
+				j.out.reJob <- j
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		for _, out := range w.outputs {
+			close(out.encrypted)
+		}
+	}()
+
+	return w, nil
+}
+
+// writeOutput writes the sealed chunks of out to dest in order.
+func (w *MultiWriter) writeOutput(out *multiOutput, index int, dest io.Writer) {
+	var err error
+
+	for e := range out.encrypted {
+		buffer := (<-e).buf
+
+		// After a failed write, keep draining so Close can finish.
+		if err == nil {
+			_, err = dest.Write(buffer)
+			if err != nil {
+				err = fmt.Errorf("destination %d: %w", index, err)
+				w.setError(err)
+			}
+		}
+		out.reBuf <- buffer[:encChunkSize]
+	}
+
+	w.done <- err
+}
+
+// send queues the chunk in w.inbuffer for every output.
+func (w *MultiWriter) send(last bool) {
+	c := &plainChunk{
+		buf:     w.inbuffer[:w.fill],
+		last:    last,
+		nonce:   w.nonce,
+		pending: int32(len(w.outputs)),
+	}
+	incNonce(&w.nonce)
+
+	for _, out := range w.outputs {
+		// The output buffer is taken here rather than by the worker, so
+		// that workers never wait on a slow destination.
+		j := <-out.reJob
+		j.chunk = c
+		j.buf = <-out.reBuf
+
+		w.todo <- j
+		out.encrypted <- j.res
+	}
+
+	w.fill = 0
+}
+
+// Write encrypts p for every destination. Errors from writing to a
+// destination are reported by a later call to Write or Close, as chunks are
+// written asynchronously, and stop all the destinations.
+func (w *MultiWriter) Write(p []byte) (n int, err error) {
+	total := len(p)
+
+	for len(p) > 0 {
+		if err := w.error(); err != nil {
+			return total - len(p), err
+		}
+
+		if w.fill == ChunkSize {
+			w.send(false)
+			w.inbuffer = <-w.reIn
+		}
+		n := copy(w.inbuffer[w.fill:ChunkSize], p)
+		w.fill += n
+		p = p[n:]
+	}
+
+	return total, nil
+}
+
+// Close encrypts the last chunk, and waits for every destination to be
+// written.
+func (w *MultiWriter) Close() error {
+	w.send(true)
+	w.inbuffer = <-w.reIn
+	close(w.todo)
+
+	for range w.outputs {
+		<-w.done
+	}
+
+	return w.error()
+}
@@ -1,6 +1,7 @@
 package stream
 
 import (
+	"bufio"
 	"crypto/cipher"
 	"errors"
 	"io"
@@ -12,10 +13,12 @@ import (
 )
 
 type Reader struct {
-	reader     io.Reader
-	readOnce   sync.Once
-	readOnceFn func()
-	writeTo    func(w io.Writer) (int64, error)
+	reader *io.PipeReader
+	writer *io.PipeWriter
+	once   sync.Once
+
+	decrypted chan chan result
+	reBuf     chan []byte
 
 	err atomic.Pointer[error]
 }
@@ -29,8 +32,9 @@ func (r *Reader) error() error {
 	return *errPtr
 }
 
-func nonceIsZero(nonce *[chacha20poly1305.NonceSize]byte) bool {
-	return *nonce == [chacha20poly1305.NonceSize]byte{}
+// setError records the first error, which also stops reading from the source.
+func (r *Reader) setError(err error) {
+	r.err.CompareAndSwap(nil, &err)
 }
 
 func NewReader(arereader io.Reader, concurrent int) *Reader {
@@ -40,34 +44,110 @@ func NewReader(arereader io.Reader, concurrent int) *Reader {
 	return newReader(a, src, concurrent)
 }
 
+// NewPayloadReader returns a Reader decrypting payload, the part of an age file
+// following the header and nonce, with the stream key derived from them.
+func NewPayloadReader(key []byte, payload io.Reader, concurrent int) (*Reader, error) {
+	a, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return newReader(a, payload, concurrent), nil
+}
+
+// NewPayloadReaderAt is like NewPayloadReader, but the workers read their
+// chunks from payload concurrently with ReadAt. size is the size of the
+// payload.
+func NewPayloadReaderAt(key []byte, payload io.ReaderAt, size int64, concurrent int) (*Reader, error) {
+	a, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return startReader(a, &readerAtSource{src: payload, size: size}, concurrent), nil
+}
+
+// NewPayloadReaderBefore is like NewPayloadReader, but payload can be followed
+// by more data starting with next, such as the header of another age file.
+//
+// The end of the payload is found by authenticating the final chunk in front
+// of every occurrence of next, and in front of the end of payload. Once the
+// Reader returns io.EOF, payload is positioned right after the payload. The
+// buffer of payload must be at least BeforeBufferSize(next).
+func NewPayloadReaderBefore(key []byte, payload *bufio.Reader, next []byte, concurrent int) (*Reader, error) {
+	a, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(next) == 0 {
+		return nil, errors.New("empty delimiter")
+	}
+	if payload.Size() < BeforeBufferSize(next) {
+		return nil, errors.New("buffer too small for NewPayloadReaderBefore")
+	}
+
+	src := &delimitedSource{
+		src:  payload,
+		next: next,
+		a:    a,
+		buf:  make([]byte, encChunkSize),
+	}
+
+	return startReader(a, src, concurrent), nil
+}
+
+// BeforeBufferSize returns the minimum buffer size of the bufio.Reader passed
+// to NewPayloadReaderBefore.
+func BeforeBufferSize(next []byte) int {
+	return encChunkSize + len(next)
+}
+
 func newReader(a cipher.AEAD, src io.Reader, concurrent int) *Reader {
+	return startReader(a, &readerSource{src: src}, concurrent)
+}
+
+func startReader(a cipher.AEAD, src source, concurrent int) *Reader {
 	if concurrent < 1 {
 		concurrent = runtime.NumCPU()
 	}
 
 	reader, writer := io.Pipe()
 
-	var nonce [chacha20poly1305.NonceSize]byte
-
 	todo := make(chan *job, concurrent)
-	decrypted := make(chan chan []byte, concurrent)
-	done := make(chan error, 1)
+	decrypted := make(chan chan result, concurrent)
 
-	// Reusable output buffer, one extra for an active job
-	// Another that is being written
-	reBuf := make(chan []byte, concurrent+2)
+	// Reusable output buffers, one for each job and one that is being written.
+	reBuf := make(chan []byte, concurrent+3)
 	// Reusable jobs.
-	// Add one extra so a job can be prepared while 'concurrent' are being decoded.
-	reJob := make(chan *job, concurrent+1)
-	for i := 0; i < concurrent+1; i++ {
+	// Add two extra so a job can be held back until the next chunk is read,
+	// and another prepared while 'concurrent' are being decoded.
+	reJob := make(chan *job, concurrent+2)
+	for i := 0; i < concurrent+2; i++ {
 		reBuf <- make([]byte, encChunkSize)
-		reJob <- &job{out: make(chan []byte, 1), in: make([]byte, encChunkSize)}
+		reJob <- &job{out: make(chan result, 1), in: make([]byte, encChunkSize)}
 	}
 	reBuf <- make([]byte, encChunkSize)
 
 	r := &Reader{
-		reader: reader,
+		reader:    reader,
+		writer:    writer,
+		decrypted: decrypted,
+		reBuf:     reBuf,
+	}
+
+	// fail queues err in order with the chunks sent before it.
+	fail := func(err *ChunkError) {
+		out := make(chan result, 1)
+		out <- result{err: err}
+		decrypted <- out
 	}
+
+	send := func(j *job) {
+		todo <- j
+		decrypted <- j.out
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
@@ -76,50 +156,7 @@ func newReader(a cipher.AEAD, src io.Reader, concurrent int) *Reader {
 			wg.Done()
 		}()
 
-		var err error
-		var n int
-
-		last := false
-
-		for !last {
-			j := <-reJob
-			buffer := j.in[:encChunkSize]
-			n, err = io.ReadFull(src, buffer)
-			switch {
-			case err == io.EOF:
-				return
-			case err == io.ErrUnexpectedEOF:
-				// The last chunk can be short, but not empty unless it's the first and
-				// only chunk.
-				if !nonceIsZero(&nonce) && n == a.Overhead() {
-					err := errors.New("last chunk is empty, try age v1.0.0, and please consider reporting this")
-
-					r.err.Store(&err)
-					writer.CloseWithError(err)
-
-					return
-				}
-
-				buffer = buffer[:n]
-				last = true
-				setLastChunkFlag(&nonce)
-
-			case err != nil:
-				r.err.Store(&err)
-				writer.CloseWithError(err)
-
-				return
-			}
-
-			j.in = buffer[:n]
-			j.last = last
-			j.nonce = nonce
-
-			todo <- j
-			decrypted <- j.out
-
-			incNonce(&nonce)
-		}
+		src.chunks(reJob, r.error, send, fail)
 	}()
 
 	wg.Add(concurrent)
@@ -127,107 +164,135 @@ func newReader(a cipher.AEAD, src io.Reader, concurrent int) *Reader {
 	for i := 0; i < concurrent; i++ {
 		go func() {
 			defer wg.Done()
-			// Track if we have seen a last nonce
-			hasSeenLast := false
-			for j := range todo {
-				if hasSeenLast && len(j.in) > 0 {
-					err := errors.New("unexpected data after last block")
 
-					r.err.Store(&err)
-					writer.CloseWithError(err)
+			for j := range todo {
+				dst := <-reBuf
 
-					return
+				var plaintext []byte
+				err := src.load(j)
+				if err == nil {
+					plaintext, err = openChunk(a, dst, j)
 				}
-				if j.last {
-					setLastChunkFlag(&j.nonce)
-					hasSeenLast = true
+				if plaintext == nil {
+					plaintext = dst[:0]
 				}
-				dst := <-reBuf
-
-				plaintext, err := a.Open(dst[:0], j.nonce[:], j.in, nil)
-				if err != nil {
-					if !j.last {
-						// Check if this was a full-length final chunk.
-						hasSeenLast = true
-						setLastChunkFlag(&j.nonce)
-						plaintext, err = a.Open(dst[:0], j.nonce[:], j.in, nil)
-					}
 
-					if err != nil {
-						err := errors.New("failed to decrypt and authenticate payload chunk")
-
-						r.err.Store(&err)
-						writer.CloseWithError(err)
-
-						return
-					}
-				}
-				j.out <- plaintext
+				j.out <- result{buf: plaintext, err: err}
 				reJob <- j
 			}
 		}()
 	}
 
-	r.readOnceFn = func() {
-		go func() {
-			for d := range decrypted {
-				buffer := <-d
+	go func() {
+		wg.Wait()
+		close(decrypted)
+	}()
 
-				// TODO: Handle write errors
-				_, _ = writer.Write(buffer)
-				reBuf <- buffer
-			}
+	return r
+}
 
-			done <- writer.Close()
-		}()
+// openChunk decrypts and authenticates the chunk in j into dst.
+//
+// The plaintext is also returned alongside Truncated and TrailingData errors,
+// as the chunk itself is authentic in those cases.
+func openChunk(a cipher.AEAD, dst []byte, j *job) ([]byte, error) {
+	nonce := j.nonce
+	if j.last {
+		setLastChunkFlag(&nonce)
 	}
 
-	r.writeTo = func(w io.Writer) (int64, error) {
-		err := r.error()
-		if err != nil {
-			return 0, err
+	plaintext, err := a.Open(dst[:0], nonce[:], j.in, nil)
+	if err == nil {
+		return plaintext, nil
+	}
+
+	if j.last {
+		// A full-length chunk that is valid as a non-final chunk means the
+		// payload stopped at a chunk boundary.
+		if len(j.in) == encChunkSize {
+			plaintext, err = a.Open(dst[:0], j.nonce[:], j.in, nil)
+			if err == nil {
+				return plaintext, newChunkError(Truncated, j.index+1)
+			}
 		}
 
-		var total int64
-		for d := range decrypted {
-			buffer := <-d
+		return nil, newChunkError(AuthFailed, j.index)
+	}
 
-			err := r.error()
-			if err != nil {
-				return total, err
-			}
+	// A full-length final chunk followed by more data.
+	setLastChunkFlag(&nonce)
+	plaintext, err = a.Open(dst[:0], nonce[:], j.in, nil)
+	if err == nil {
+		return plaintext, newChunkError(TrailingData, j.index+1)
+	}
+
+	return nil, newChunkError(AuthFailed, j.index)
+}
 
-			n, err := w.Write(buffer)
-			reBuf <- buffer
+// consume writes the decrypted chunks to w in order until the end of the
+// payload or the first error.
+func (r *Reader) consume(w io.Writer) (int64, error) {
+	var total int64
+
+	for d := range r.decrypted {
+		res := <-d
+
+		var err error
+		if len(res.buf) > 0 {
+			var n int
+			n, err = w.Write(res.buf)
 			total += int64(n)
-			if err != nil {
-				writer.CloseWithError(err)
-				// FIXME: Drain decrypted?
-				return total, err
-			}
+		}
+		if res.buf != nil {
+			r.reBuf <- res.buf
+		}
+		if err == nil {
+			err = res.err
 		}
 
-		err = r.error()
 		if err != nil {
+			r.setError(err)
+
+			// Let the remaining workers finish in the background.
+			go func() {
+				for d := range r.decrypted {
+					res := <-d
+					if res.buf != nil {
+						r.reBuf <- res.buf
+					}
+				}
+			}()
+
 			return total, err
 		}
-
-		return total, writer.Close()
 	}
 
-	go func() {
-		wg.Wait()
-		close(decrypted)
-	}()
-
-	return r
+	return total, nil
 }
 
 func (r *Reader) Read(p []byte) (int, error) {
-	r.readOnce.Do(r.readOnceFn)
+	r.once.Do(func() {
+		go func() {
+			_, err := r.consume(r.writer)
+			r.writer.CloseWithError(err)
+		}()
+	})
+
 	return r.reader.Read(p)
 }
 
 func (r *Reader) WriteTo(w io.Writer) (int64, error) {
-	return r.writeTo(w)
+	started := true
+	r.once.Do(func() {
+		started = false
+	})
+	if started {
+		// Read was called first, continue from the pipe.
+		return io.Copy(w, r.reader)
+	}
+
+	n, err := r.consume(w)
+	r.writer.CloseWithError(err)
+
+	return n, err
 }
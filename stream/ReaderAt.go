@@ -0,0 +1,215 @@
+package stream
+
+import (
+	"crypto/cipher"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ReaderAt provides random access to the plaintext of a payload, decrypting
+// only the chunks covering each read. Reads spanning several chunks are
+// decrypted concurrently.
+//
+// The last chunk is authenticated when the ReaderAt is created, so Size can be
+// trusted. Other chunks are authenticated as they are read.
+type ReaderAt struct {
+	a          cipher.AEAD
+	src        *readerAtSource
+	size       int64
+	chunks     int64
+	concurrent int
+
+	bufs sync.Pool
+
+	// The most recently decrypted chunk, for callers reading in small pieces.
+	mu          sync.Mutex
+	cachedIndex int64
+	cached      []byte
+}
+
+// NewReaderAt returns a ReaderAt for payload, the part of an age file following
+// the header and nonce, decrypting with the stream key derived from them. size
+// is the size of the payload.
+func NewReaderAt(key []byte, payload io.ReaderAt, size int64, concurrent int) (*ReaderAt, error) {
+	a, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return newReaderAt(a, payload, size, concurrent)
+}
+
+func newReaderAt(a cipher.AEAD, payload io.ReaderAt, size int64, concurrent int) (*ReaderAt, error) {
+	if concurrent < 1 {
+		concurrent = runtime.NumCPU()
+	}
+
+	plaintextSize, err := DecryptedSize(size)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ReaderAt{
+		a:           a,
+		src:         &readerAtSource{src: payload, size: size},
+		size:        plaintextSize,
+		chunks:      (size + encChunkSize - 1) / encChunkSize,
+		concurrent:  concurrent,
+		cachedIndex: -1,
+	}
+	r.bufs.New = func() any {
+		return make([]byte, encChunkSize)
+	}
+
+	// Authenticate the last chunk up front, so the size can be trusted.
+	err = r.chunk(r.chunks-1, func(plaintext []byte) {})
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Size returns the size of the plaintext.
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+// chunk decrypts chunk index and passes its plaintext to fn.
+func (r *ReaderAt) chunk(index int64, fn func(plaintext []byte)) error {
+	r.mu.Lock()
+	if r.cachedIndex == index {
+		fn(r.cached)
+		r.mu.Unlock()
+
+		return nil
+	}
+	r.mu.Unlock()
+
+	in := r.bufs.Get().([]byte)
+	defer r.bufs.Put(in)
+
+	out := r.bufs.Get().([]byte)
+	defer r.bufs.Put(out)
+
+	j := &job{
+		index: index,
+		last:  index == r.chunks-1,
+		in:    in[:encChunkSize],
+	}
+	if j.last {
+		j.in = in[:r.src.size-index*encChunkSize]
+	}
+	setNonce(&j.nonce, index)
+
+	err := r.src.load(j)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := openChunk(r.a, out, j)
+	if err != nil {
+		return err
+	}
+
+	fn(plaintext)
+
+	r.mu.Lock()
+	r.cachedIndex = index
+	r.cached = append(r.cached[:0], plaintext...)
+	r.mu.Unlock()
+
+	return nil
+}
+
+// ReadAt decrypts len(p) bytes of plaintext starting at off into p.
+//
+// It returns io.EOF when the read reaches the end of the plaintext, and a
+// *ChunkError when a chunk can't be read or authenticated.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("stream: negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	var eof error
+	if int64(len(p)) > r.size-off {
+		p = p[:r.size-off]
+		eof = io.EOF
+	}
+	if len(p) == 0 {
+		return 0, eof
+	}
+
+	end := off + int64(len(p))
+	first := off / ChunkSize
+	last := (end - 1) / ChunkSize
+
+	workers := int64(r.concurrent)
+	if workers > last-first+1 {
+		workers = last - first + 1
+	}
+
+	var next int64 = first
+	var errs firstError
+
+	work := func() {
+		for errs.get() == nil {
+			index := atomic.AddInt64(&next, 1) - 1
+			if index > last {
+				return
+			}
+
+			err := r.chunk(index, func(plaintext []byte) {
+				start := index * ChunkSize
+				if start < off {
+					plaintext = plaintext[off-start:]
+					start = off
+				}
+
+				copy(p[start-off:], plaintext)
+			})
+			if err != nil {
+				errs.set(index, err)
+			}
+		}
+	}
+
+	if workers == 1 {
+		// Small reads within a chunk don't need to start a goroutine.
+		work()
+	} else {
+		var wg sync.WaitGroup
+		wg.Add(int(workers))
+
+		for i := int64(0); i < workers; i++ {
+			go func() {
+				defer wg.Done()
+
+				work()
+			}()
+		}
+
+		wg.Wait()
+	}
+
+	err := errs.get()
+	if err != nil {
+		// Everything before the failed chunk has been read.
+		n := errs.index*ChunkSize - off
+		if n < 0 {
+			n = 0
+		}
+
+		return int(n), err
+	}
+
+	return len(p), eof
+}
@@ -0,0 +1,118 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestReaderAt(t *testing.T) {
+	a := testAEAD(t)
+
+	for _, l := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 10*ChunkSize + 7} {
+		t.Run(fmt.Sprintf("%d", l), func(t *testing.T) {
+			plaintext := make([]byte, l)
+			for i := range plaintext {
+				plaintext[i] = byte(i * 7)
+			}
+
+			payload := encryptPayload(t, a, plaintext)
+
+			r, err := newReaderAt(a, bytes.NewReader(payload), int64(len(payload)), 3)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if r.Size() != int64(l) {
+				t.Fatalf("unexpected size: %d", r.Size())
+			}
+
+			ranges := [][2]int{
+				{0, l},
+				{0, l + 10},
+				{l / 2, l},
+				{l / 3, l / 3 * 2},
+				{ChunkSize - 3, ChunkSize + 3},
+				{l, l + 1},
+			}
+
+			for _, rng := range ranges {
+				start, end := rng[0], rng[1]
+				if start > l {
+					continue
+				}
+
+				buf := make([]byte, end-start)
+
+				n, err := r.ReadAt(buf, int64(start))
+				switch {
+				case end > l || start == l:
+					if err != io.EOF {
+						t.Fatalf("expected EOF for %d-%d, got %v", start, end, err)
+					}
+					end = l
+				case err != nil:
+					t.Fatalf("unexpected error for %d-%d: %v", start, end, err)
+				}
+
+				if n != end-start || !bytes.Equal(buf[:n], plaintext[start:end]) {
+					t.Fatalf("unexpected output for %d-%d", start, end)
+				}
+			}
+
+			out := bytes.NewBuffer(nil)
+
+			_, err = io.Copy(out, io.NewSectionReader(r, 0, r.Size()))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(out.Bytes(), plaintext) {
+				t.Fatalf("unexpected output")
+			}
+		})
+	}
+}
+
+func TestReaderAtErrors(t *testing.T) {
+	a := testAEAD(t)
+
+	payload := encryptPayload(t, a, make([]byte, 5*ChunkSize+10))
+
+	_, err := newReaderAt(a, bytes.NewReader(payload[:4*encChunkSize]), 4*encChunkSize, 2)
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected truncation error, got %v", err)
+	}
+
+	_, err = newReaderAt(a, bytes.NewReader(payload[:4*encChunkSize+5]), 4*encChunkSize+5, 2)
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected truncation error, got %v", err)
+	}
+
+	tampered := append([]byte{}, payload...)
+	tampered[2*encChunkSize+10] ^= 0x01
+
+	r, err := newReaderAt(a, bytes.NewReader(tampered), int64(len(tampered)), 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	buf := make([]byte, 4*ChunkSize)
+
+	n, err := r.ReadAt(buf, ChunkSize+5)
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("expected authentication error, got %v", err)
+	}
+
+	if n != ChunkSize-5 {
+		t.Errorf("unexpected length: %d", n)
+	}
+
+	// Chunks before the tampered one are still readable.
+	_, err = r.ReadAt(buf[:100], 10)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -3,8 +3,10 @@ package stream
 import (
 	"crypto/cipher"
 	"io"
+	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
 
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -34,9 +36,15 @@ func setLastChunkFlag(nonce *[chacha20poly1305.NonceSize]byte) {
 
 type job struct {
 	last  bool
+	index int64
 	in    []byte
 	nonce [chacha20poly1305.NonceSize]byte
-	out   chan []byte
+	out   chan result
+}
+
+type result struct {
+	buf []byte
+	err error
 }
 
 type Writer struct {
@@ -47,10 +55,22 @@ type Writer struct {
 	inbuffer  []byte
 	fill      int
 	todo      chan *job
-	encrypted chan chan []byte
+	encrypted chan chan result
 	reBuf     chan []byte
 	reJob     chan *job
 	done      chan error
+	closed    bool
+
+	err atomic.Pointer[error]
+}
+
+func (w *Writer) error() error {
+	errPtr := w.err.Load()
+	if errPtr == nil {
+		return nil
+	}
+
+	return *errPtr
 }
 
 func NewWriter(agewriter io.Writer, dest io.Writer, concurrent int) *Writer {
@@ -59,6 +79,18 @@ func NewWriter(agewriter io.Writer, dest io.Writer, concurrent int) *Writer {
 	return newWriter(a, dest, concurrent)
 }
 
+// NewPayloadWriter returns a Writer encrypting to dest with the stream key
+// derived from the file key and payload nonce, which must already have been
+// written to dest along with the header.
+func NewPayloadWriter(key []byte, dest io.Writer, concurrent int) (*Writer, error) {
+	a, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return newWriter(a, dest, concurrent), nil
+}
+
 func newWriter(a cipher.AEAD, dest io.Writer, concurrent int) *Writer {
 	if concurrent < 1 {
 		concurrent = runtime.NumCPU()
@@ -69,28 +101,30 @@ func newWriter(a cipher.AEAD, dest io.Writer, concurrent int) *Writer {
 
 		inbuffer:  make([]byte, ChunkSize+chacha20poly1305.Overhead),
 		todo:      make(chan *job, concurrent),
-		encrypted: make(chan chan []byte, concurrent),
-		done:      make(chan error),
+		encrypted: make(chan chan result, concurrent),
+		done:      make(chan error, 1),
 		reBuf:     make(chan []byte, concurrent), // reuse of blocks
 		reJob:     make(chan *job, concurrent),   // reuse of jobs (in shouldn't be)
 	}
 	for i := 0; i < concurrent; i++ {
 		w.reBuf <- make([]byte, ChunkSize+chacha20poly1305.Overhead)
-		w.reJob <- &job{out: make(chan []byte, 1)}
+		w.reJob <- &job{out: make(chan result, 1)}
 	}
 	go func() {
+		var err error
 		for e := range w.encrypted {
-			buffer := <-e
+			buffer := (<-e).buf
 
-			_, err := dest.Write(buffer)
-			if err != nil {
-				// FIXME: Deal with this error somehow.
-				// Send them on the done channel.
-				panic(err)
+			// After a failed write, keep draining so Close can finish.
+			if err == nil {
+				_, err = dest.Write(buffer)
+				if err != nil {
+					w.err.Store(&err)
+				}
 			}
 			w.reBuf <- buffer
 		}
-		close(w.done)
+		w.done <- err
 	}()
 
 	var wg sync.WaitGroup
@@ -103,7 +137,7 @@ func newWriter(a cipher.AEAD, dest io.Writer, concurrent int) *Writer {
 					setLastChunkFlag(&j.nonce)
 				}
 				out := w.a.Seal(j.in[:0], j.nonce[:], j.in, nil)
-				j.out <- out
+				j.out <- result{buf: out}
 				w.reJob <- j
 			}
 			wg.Done()
@@ -118,10 +152,20 @@ func newWriter(a cipher.AEAD, dest io.Writer, concurrent int) *Writer {
 	return w
 }
 
+// Write encrypts p. Errors from writing to the destination are reported by a
+// later call to Write or Close, as chunks are written asynchronously.
 func (w *Writer) Write(p []byte) (n int, err error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
 	total := len(p)
 
 	for len(p) > 0 {
+		if err := w.error(); err != nil {
+			return total - len(p), err
+		}
+
 		if w.fill == ChunkSize {
 			j := <-w.reJob
 			j.last = false
@@ -144,7 +188,14 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	return total, nil
 }
 
+// Close seals the last chunk, and waits for all the chunks to be written to
+// the destination.
 func (w *Writer) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+
 	j := <-w.reJob
 	j.last = true
 	j.in = w.inbuffer[:w.fill]
@@ -157,3 +208,16 @@ func (w *Writer) Close() error {
 	close(w.todo)
 	return <-w.done
 }
+
+// Abort stops the workers without sealing a last chunk, so that the
+// destination never holds a complete payload. Chunks sealed before may still
+// be written to it. Abort does nothing after Close or Abort.
+func (w *Writer) Abort() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+
+	close(w.todo)
+	<-w.done
+}
@@ -0,0 +1,143 @@
+package stream
+
+import (
+	"crypto/cipher"
+	"io"
+	"runtime"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// firstError keeps the error of the lowest chunk index.
+type firstError struct {
+	mu    sync.Mutex
+	index int64
+	err   error
+}
+
+func (f *firstError) set(index int64, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err == nil || index < f.index {
+		f.index = index
+		f.err = err
+	}
+}
+
+func (f *firstError) get() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.err
+}
+
+// DecryptToWriterAt decrypts the payload of agereader, as returned by
+// age.Decrypt, into dst.
+//
+// Every worker writes its chunk to dst at the chunk's plaintext offset as soon
+// as it has been authenticated, so chunks are written out of order. It
+// returns the size of the plaintext once the last chunk has been
+// authenticated. If dst has a Truncate method, like *os.File, it's truncated to
+// that size.
+//
+// On error the content of dst is undefined, and must not be used.
+func DecryptToWriterAt(dst io.WriterAt, agereader io.Reader, concurrent int) (int64, error) {
+	a := extract[cipher.AEAD](agereader, "a")
+	src := extract[io.Reader](agereader, "src")
+
+	return decryptToWriterAt(a, &readerSource{src: src}, dst, concurrent)
+}
+
+// DecryptPayloadToWriterAt is like DecryptToWriterAt, but decrypts payload,
+// the part of an age file following the header and nonce, with the stream key
+// derived from them.
+func DecryptPayloadToWriterAt(dst io.WriterAt, key []byte, payload io.Reader, concurrent int) (int64, error) {
+	a, err := chacha20poly1305.New(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return decryptToWriterAt(a, &readerSource{src: payload}, dst, concurrent)
+}
+
+func decryptToWriterAt(a cipher.AEAD, src source, dst io.WriterAt, concurrent int) (int64, error) {
+	if concurrent < 1 {
+		concurrent = runtime.NumCPU()
+	}
+
+	todo := make(chan *job, concurrent)
+
+	// Reusable jobs.
+	// Add two extra so a job can be held back until the next chunk is read,
+	// and another prepared while 'concurrent' are being decoded.
+	reJob := make(chan *job, concurrent+2)
+	for i := 0; i < concurrent+2; i++ {
+		reJob <- &job{in: make([]byte, encChunkSize)}
+	}
+
+	var errs firstError
+	var size int64
+
+	var wg sync.WaitGroup
+	wg.Add(concurrent)
+
+	for i := 0; i < concurrent; i++ {
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, encChunkSize)
+
+			for j := range todo {
+				var plaintext []byte
+				err := src.load(j)
+				if err == nil {
+					plaintext, err = openChunk(a, buf, j)
+				}
+				if len(plaintext) > 0 {
+					_, werr := dst.WriteAt(plaintext, j.index*ChunkSize)
+					if werr != nil {
+						err = werr
+					}
+				}
+
+				switch {
+				case err != nil:
+					errs.set(j.index, err)
+				case j.last:
+					// Only one job is ever marked as last.
+					size = j.index*ChunkSize + int64(len(plaintext))
+				}
+
+				reJob <- j
+			}
+		}()
+	}
+
+	src.chunks(reJob, errs.get,
+		func(j *job) {
+			todo <- j
+		},
+		func(err *ChunkError) {
+			errs.set(err.Index, err)
+		},
+	)
+
+	close(todo)
+	wg.Wait()
+
+	err := errs.get()
+	if err != nil {
+		return 0, err
+	}
+
+	if t, ok := dst.(interface{ Truncate(int64) error }); ok {
+		err = t.Truncate(size)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return size, nil
+}
@@ -0,0 +1,88 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+type memWriterAt struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (m *memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if end := int(off) + len(p); end > len(m.buf) {
+		m.buf = append(m.buf, make([]byte, end-len(m.buf))...)
+	}
+
+	return copy(m.buf[off:], p), nil
+}
+
+func TestDecryptToWriterAt(t *testing.T) {
+	a := testAEAD(t)
+
+	for _, l := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 10*ChunkSize + 7} {
+		t.Run(fmt.Sprintf("%d", l), func(t *testing.T) {
+			plaintext := make([]byte, l)
+			for i := range plaintext {
+				plaintext[i] = byte(i * 7)
+			}
+
+			dst := &memWriterAt{}
+
+			n, err := decryptToWriterAt(a, &readerSource{src: bytes.NewReader(encryptPayload(t, a, plaintext))}, dst, 4)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if n != int64(l) {
+				t.Fatalf("unexpected length: %d", n)
+			}
+
+			if !bytes.Equal(dst.buf, plaintext) {
+				t.Fatalf("unexpected output")
+			}
+		})
+	}
+}
+
+func TestDecryptToWriterAtErrors(t *testing.T) {
+	a := testAEAD(t)
+
+	payload := encryptPayload(t, a, make([]byte, 5*ChunkSize+10))
+
+	tampered := append([]byte{}, payload...)
+	tampered[3*encChunkSize+10] ^= 0x01
+
+	cases := []struct {
+		name  string
+		data  []byte
+		kind  ErrorKind
+		index int64
+	}{
+		{"truncated", payload[:4*encChunkSize], Truncated, 4},
+		{"tampered", tampered, AuthFailed, 3},
+		{"trailing", append(payload, 1), AuthFailed, 5},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := decryptToWriterAt(a, &readerSource{src: bytes.NewReader(c.data)}, &memWriterAt{}, 4)
+
+			var chunkErr *ChunkError
+			if !errors.As(err, &chunkErr) {
+				t.Fatalf("expected ChunkError, got %v", err)
+			}
+
+			if chunkErr.Kind != c.kind || chunkErr.Index != c.index {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -1,9 +1,12 @@
 package stream
 
 import (
+	"bytes"
 	"crypto/cipher"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"testing"
 
 	realage "filippo.io/age"
@@ -61,3 +64,74 @@ func BenchmarkWriter(b *testing.B) {
 		})
 	}
 }
+
+type failingWriter struct {
+	after int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.after {
+		n := f.after
+		f.after = 0
+
+		return n, errors.New("write error")
+	}
+
+	f.after -= len(p)
+
+	return len(p), nil
+}
+
+func TestWriterDestError(t *testing.T) {
+	a := testAEAD(t)
+
+	for _, after := range []int{0, 100, 3 * encChunkSize} {
+		t.Run(fmt.Sprintf("%d", after), func(t *testing.T) {
+			w := newWriter(a, &failingWriter{after: after}, 2)
+
+			buf := make([]byte, ChunkSize)
+
+			var err error
+			for i := 0; i < 100 && err == nil; i++ {
+				_, err = w.Write(buf)
+			}
+
+			cerr := w.Close()
+			if cerr == nil || cerr.Error() != "write error" {
+				t.Fatalf("unexpected error from Close: %v", cerr)
+			}
+
+			if err == nil || err.Error() != "write error" {
+				t.Errorf("unexpected error from Write: %v", err)
+			}
+		})
+	}
+}
+
+func TestWriterAbort(t *testing.T) {
+	a := testAEAD(t)
+
+	for _, size := range []int{0, 100, ChunkSize, 3*ChunkSize + 100} {
+		t.Run(fmt.Sprintf("%d", size), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			w := newWriter(a, buf, 2)
+
+			if _, err := w.Write(make([]byte, size)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w.Abort()
+			w.Abort()
+
+			// Only full chunks sealed before Abort are written, never a last
+			// chunk.
+			if buf.Len()%encChunkSize != 0 || buf.Len() > size/ChunkSize*encChunkSize {
+				t.Errorf("unexpected output of %d bytes", buf.Len())
+			}
+
+			if err := w.Close(); !errors.Is(err, os.ErrClosed) {
+				t.Errorf("expected ErrClosed from Close after Abort, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package stream
+
+import (
+	"crypto/cipher"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// EncryptBytesToWriterAt encrypts plaintext with the stream key derived from
+// the file key and payload nonce, and writes the payload to dst starting at
+// offset. It returns the size of the payload.
+//
+// Every worker seals its chunks directly from plaintext, which can be a memory
+// mapped file, and writes them at their final position.
+func EncryptBytesToWriterAt(dst io.WriterAt, offset int64, key []byte, plaintext []byte, concurrent int) (int64, error) {
+	a, err := chacha20poly1305.New(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return encryptBytes(a, dst, offset, plaintext, concurrent)
+}
+
+func encryptBytes(a cipher.AEAD, dst io.WriterAt, offset int64, plaintext []byte, concurrent int) (int64, error) {
+	if concurrent < 1 {
+		concurrent = runtime.NumCPU()
+	}
+
+	size := int64(len(plaintext))
+	chunks := (size + ChunkSize - 1) / ChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	var next int64
+	var errs firstError
+
+	var wg sync.WaitGroup
+	wg.Add(concurrent)
+
+	for i := 0; i < concurrent; i++ {
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, encChunkSize)
+
+			var nonce [chacha20poly1305.NonceSize]byte
+
+			for errs.get() == nil {
+				index := atomic.AddInt64(&next, 1) - 1
+				if index >= chunks {
+					return
+				}
+
+				start := index * ChunkSize
+				end := start + ChunkSize
+				if end > size {
+					end = size
+				}
+
+				setNonce(&nonce, index)
+				if index == chunks-1 {
+					setLastChunkFlag(&nonce)
+				}
+
+				out := a.Seal(buf[:0], nonce[:], plaintext[start:end], nil)
+
+				_, err := dst.WriteAt(out, offset+index*encChunkSize)
+				if err != nil {
+					errs.set(index, err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	err := errs.get()
+	if err != nil {
+		return 0, err
+	}
+
+	return EncryptedSize(size), nil
+}
+
+// DecryptBytesToWriterAt is like DecryptPayloadToWriterAt, but the workers
+// open the chunks directly from payload, which can be a memory mapped file.
+func DecryptBytesToWriterAt(dst io.WriterAt, key []byte, payload []byte, concurrent int) (int64, error) {
+	a, err := chacha20poly1305.New(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return decryptToWriterAt(a, &bytesSource{buf: payload}, dst, concurrent)
+}
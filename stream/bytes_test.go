@@ -0,0 +1,54 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestEncryptBytes(t *testing.T) {
+	a := testAEAD(t)
+
+	for _, l := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 10*ChunkSize + 7} {
+		t.Run(fmt.Sprintf("%d", l), func(t *testing.T) {
+			plaintext := make([]byte, l)
+			for i := range plaintext {
+				plaintext[i] = byte(i * 7)
+			}
+
+			dst := &memWriterAt{}
+
+			n, err := encryptBytes(a, dst, 5, plaintext, 3)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The result must be identical to the streaming Writer.
+			expected := encryptPayload(t, a, plaintext)
+
+			if n != int64(len(expected)) || n != EncryptedSize(int64(l)) {
+				t.Fatalf("unexpected length: %d", n)
+			}
+
+			if !bytes.Equal(dst.buf[5:], expected) {
+				t.Fatalf("unexpected output")
+			}
+
+			size, err := DecryptedSize(n)
+			if err != nil || size != int64(l) {
+				t.Fatalf("unexpected decrypted size: %d, %v", size, err)
+			}
+
+			out := &memWriterAt{}
+
+			m, err := decryptToWriterAt(a, &bytesSource{buf: expected}, out, 3)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if m != int64(l) || !bytes.Equal(out.buf, plaintext) {
+				t.Fatalf("unexpected output")
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorKind classifies why a payload chunk could not be decrypted.
+type ErrorKind int
+
+const (
+	// Truncated means the payload ended before its final chunk. Retrying
+	// with a complete copy of the file may succeed.
+	Truncated ErrorKind = iota + 1
+
+	// AuthFailed means a chunk did not authenticate, the payload has been
+	// modified or was encrypted with a different key.
+	//
+	// A payload cut short in the middle of its final chunk can't be told
+	// apart from a modified one, and is reported as AuthFailed.
+	AuthFailed
+
+	// TrailingData means there is data after the final chunk.
+	TrailingData
+
+	// EmptyLastChunk means the final chunk is empty without being the only
+	// chunk, which age v1.0.0 and later never produce.
+	EmptyLastChunk
+
+	// ReadFailed means reading from the source failed, the underlying error
+	// is available through errors.Unwrap.
+	ReadFailed
+)
+
+// Sentinel errors matching a ChunkError of the corresponding kind with
+// errors.Is.
+var (
+	ErrTruncated      = errors.New("payload is truncated")
+	ErrAuthFailed     = errors.New("failed to decrypt and authenticate payload chunk")
+	ErrTrailingData   = errors.New("unexpected data after last chunk")
+	ErrEmptyLastChunk = errors.New("last chunk is empty, try age v1.0.0, and please consider reporting this")
+	ErrReadFailed     = errors.New("failed to read payload")
+)
+
+func (k ErrorKind) sentinel() error {
+	switch k {
+	case Truncated:
+		return ErrTruncated
+	case AuthFailed:
+		return ErrAuthFailed
+	case TrailingData:
+		return ErrTrailingData
+	case EmptyLastChunk:
+		return ErrEmptyLastChunk
+	case ReadFailed:
+		return ErrReadFailed
+	}
+
+	return nil
+}
+
+func (k ErrorKind) String() string {
+	switch k {
+	case Truncated:
+		return "Truncated"
+	case AuthFailed:
+		return "AuthFailed"
+	case TrailingData:
+		return "TrailingData"
+	case EmptyLastChunk:
+		return "EmptyLastChunk"
+	case ReadFailed:
+		return "ReadFailed"
+	}
+
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+// ChunkError is returned by Reader when the payload can't be decrypted.
+//
+// Offsets are relative to the start of the payload, which is right after the
+// header and nonce of an age file. All plaintext before PlaintextOffset has
+// been authenticated and returned to the caller.
+type ChunkError struct {
+	Kind ErrorKind
+
+	// Index of the chunk that failed.
+	Index int64
+
+	// CiphertextOffset is the position in the payload where the problem was
+	// detected. For ReadFailed this is the number of payload bytes read
+	// successfully.
+	CiphertextOffset int64
+
+	// PlaintextOffset is the position in the plaintext of the chunk.
+	PlaintextOffset int64
+
+	// Err is the underlying error for ReadFailed, nil otherwise.
+	Err error
+}
+
+func newChunkError(kind ErrorKind, index int64) *ChunkError {
+	return &ChunkError{
+		Kind:             kind,
+		Index:            index,
+		CiphertextOffset: index * encChunkSize,
+		PlaintextOffset:  index * ChunkSize,
+	}
+}
+
+func (e *ChunkError) Error() string {
+	msg := fmt.Sprintf("%v at chunk %d (payload offset %d)", e.Kind.sentinel(), e.Index, e.CiphertextOffset)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+
+	return msg
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the sentinel error for the kind of e.
+func (e *ChunkError) Is(target error) bool {
+	return target != nil && target == e.Kind.sentinel()
+}
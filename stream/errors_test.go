@@ -0,0 +1,231 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func testAEAD(t testing.TB) cipher.AEAD {
+	a, err := chacha20poly1305.New([]byte("key1key1key1key1key1key1key1key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+func encryptPayload(t testing.TB, a cipher.AEAD, plaintext []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+
+	w := newWriter(a, buf, 2)
+
+	_, err := w.Write(plaintext)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+type failingReader struct {
+	r     io.Reader
+	after int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.after == 0 {
+		return 0, errors.New("read error")
+	}
+	if len(p) > f.after {
+		p = p[:f.after]
+	}
+
+	n, err := f.r.Read(p)
+	f.after -= n
+
+	return n, err
+}
+
+func TestReaderErrors(t *testing.T) {
+	a := testAEAD(t)
+
+	plaintext := make([]byte, 3*ChunkSize+100)
+	for i := range plaintext {
+		plaintext[i] = byte(i)
+	}
+
+	payload := encryptPayload(t, a, plaintext)
+	fullLast := encryptPayload(t, a, plaintext[:2*ChunkSize])
+
+	// Written by age before v1.0.0: a full chunk followed by an empty one.
+	var nonce [chacha20poly1305.NonceSize]byte
+	emptyLast := a.Seal(nil, nonce[:], plaintext[:ChunkSize], nil)
+	incNonce(&nonce)
+	setLastChunkFlag(&nonce)
+	emptyLast = a.Seal(emptyLast, nonce[:], nil, nil)
+
+	tampered := append([]byte{}, payload...)
+	tampered[encChunkSize+10] ^= 0x01
+
+	cases := []struct {
+		name   string
+		data   []byte
+		after  int
+		kind   ErrorKind
+		index  int64
+		offset int64
+	}{
+		{"empty", nil, 0, Truncated, 0, 0},
+		{"boundary", payload[:2*encChunkSize], 0, Truncated, 2, 2 * encChunkSize},
+		{"short", payload[:2*encChunkSize+10], 0, Truncated, 2, 2 * encChunkSize},
+		{"partial", payload[:2*encChunkSize+50], 0, AuthFailed, 2, 2 * encChunkSize},
+		{"tampered", tampered, 0, AuthFailed, 1, encChunkSize},
+		{"trailing", append(fullLast, 1, 2, 3), 0, TrailingData, 2, 2 * encChunkSize},
+		{"emptylast", emptyLast, 0, EmptyLastChunk, 1, encChunkSize},
+		{"readerror", payload, encChunkSize + 5, ReadFailed, 1, encChunkSize + 5},
+	}
+
+	for _, c := range cases {
+		for _, mode := range []string{"read", "writeto", "readat", "before"} {
+			t.Run(fmt.Sprintf("%s:%s", c.name, mode), func(t *testing.T) {
+				var r *Reader
+
+				switch {
+				case mode == "readat" && c.after > 0:
+					t.Skip("read errors are tested with io.Reader sources")
+				case mode == "readat":
+					r = startReader(a, &readerAtSource{src: bytes.NewReader(c.data), size: int64(len(c.data))}, 4)
+				case mode == "before":
+					var src io.Reader = bytes.NewReader(c.data)
+					if c.after > 0 {
+						src = &failingReader{r: src, after: c.after}
+					}
+					r = startReader(a, &delimitedSource{
+						src:  bufio.NewReaderSize(src, BeforeBufferSize([]byte("next"))),
+						next: []byte("next"),
+						a:    a,
+						buf:  make([]byte, encChunkSize),
+					}, 4)
+				case c.after > 0:
+					r = newReader(a, &failingReader{r: bytes.NewReader(c.data), after: c.after}, 4)
+				default:
+					r = newReader(a, bytes.NewReader(c.data), 4)
+				}
+
+				out := bytes.NewBuffer(nil)
+
+				var err error
+				if mode == "writeto" {
+					_, err = r.WriteTo(out)
+				} else {
+					_, err = io.Copy(out, struct{ io.Reader }{r})
+				}
+
+				var chunkErr *ChunkError
+				if !errors.As(err, &chunkErr) {
+					t.Fatalf("expected ChunkError, got %v", err)
+				}
+
+				if !errors.Is(err, c.kind.sentinel()) {
+					t.Errorf("expected errors.Is(%v, %v)", err, c.kind.sentinel())
+				}
+
+				if chunkErr.Kind != c.kind || chunkErr.Index != c.index || chunkErr.CiphertextOffset != c.offset {
+					t.Errorf("unexpected error: %+v", chunkErr)
+				}
+
+				if int64(out.Len()) != chunkErr.PlaintextOffset {
+					t.Errorf("unexpected plaintext length: %d, error at %d", out.Len(), chunkErr.PlaintextOffset)
+				}
+
+				if !bytes.Equal(out.Bytes(), plaintext[:out.Len()]) {
+					t.Errorf("unexpected output")
+				}
+			})
+		}
+	}
+}
+
+func TestReaderReadErrorUnwrap(t *testing.T) {
+	a := testAEAD(t)
+
+	payload := encryptPayload(t, a, make([]byte, 100))
+
+	r := newReader(a, io.MultiReader(bytes.NewReader(payload[:10]), &failingReader{}), 1)
+
+	_, err := io.Copy(io.Discard, r)
+	if err == nil || err.Error() != "failed to read payload at chunk 0 (payload offset 10): read error" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if errors.Unwrap(err) == nil || errors.Unwrap(err).Error() != "read error" {
+		t.Errorf("expected wrapped read error, got %v", errors.Unwrap(err))
+	}
+}
+
+func TestReaderAtShortSource(t *testing.T) {
+	a := testAEAD(t)
+
+	payload := encryptPayload(t, a, make([]byte, 3*ChunkSize))
+
+	// The source is shorter than the size it was opened with.
+	r := startReader(a, &readerAtSource{src: bytes.NewReader(payload[:encChunkSize+5]), size: int64(len(payload))}, 2)
+
+	_, err := io.Copy(io.Discard, r)
+	if !errors.Is(err, ErrReadFailed) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var chunkErr *ChunkError
+	if !errors.As(err, &chunkErr) || chunkErr.Index != 1 || chunkErr.CiphertextOffset != encChunkSize+5 {
+		t.Errorf("unexpected error: %+v", chunkErr)
+	}
+}
+
+func TestPayloadReaderBefore(t *testing.T) {
+	key := []byte("key1key1key1key1key1key1key1key1")
+	a := testAEAD(t)
+	next := []byte("next")
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 2 * ChunkSize} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			plaintext := make([]byte, size)
+			for i := range plaintext {
+				plaintext[i] = byte(i)
+			}
+
+			payload := encryptPayload(t, a, plaintext)
+			src := bufio.NewReaderSize(bytes.NewReader(append(payload, "next file"...)), BeforeBufferSize(next))
+
+			r, err := NewPayloadReaderBefore(key, src, next, 3)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			out, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(out, plaintext) {
+				t.Fatalf("plaintext mismatch")
+			}
+
+			rest, _ := io.ReadAll(src)
+			if string(rest) != "next file" {
+				t.Fatalf("unexpected data after the payload: %q", rest)
+			}
+		})
+	}
+}
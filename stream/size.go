@@ -0,0 +1,44 @@
+package stream
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// EncryptedSize returns the size of the payload for a plaintext of the given
+// size.
+func EncryptedSize(plaintextSize int64) int64 {
+	chunks := (plaintextSize + ChunkSize - 1) / ChunkSize
+	if chunks == 0 {
+		// An empty plaintext is still one empty chunk.
+		chunks = 1
+	}
+
+	return plaintextSize + chunks*chacha20poly1305.Overhead
+}
+
+// DecryptedSize returns the size of the plaintext for a payload of the given
+// size. It fails with a *ChunkError if no valid payload has that size.
+func DecryptedSize(payloadSize int64) (int64, error) {
+	chunks := (payloadSize + encChunkSize - 1) / encChunkSize
+	lastSize := payloadSize - (chunks-1)*encChunkSize
+
+	switch {
+	case chunks == 0:
+		return 0, newChunkError(Truncated, 0)
+	case lastSize < chacha20poly1305.Overhead:
+		return 0, newChunkError(Truncated, chunks-1)
+	case chunks > 1 && lastSize == chacha20poly1305.Overhead:
+		return 0, newChunkError(EmptyLastChunk, chunks-1)
+	}
+
+	return payloadSize - chunks*chacha20poly1305.Overhead, nil
+}
+
+// setNonce sets the nonce to the one of chunk index, without the last chunk
+// flag.
+func setNonce(nonce *[chacha20poly1305.NonceSize]byte, index int64) {
+	*nonce = [chacha20poly1305.NonceSize]byte{}
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:len(nonce)-1], uint64(index))
+}
@@ -0,0 +1,314 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// source produces the chunks of a payload for the workers.
+type source interface {
+	// chunks passes every chunk to send in order, with the last chunk marked
+	// as such, until the end of the payload, the first error, or until
+	// stopped returns an error.
+	chunks(reJob chan *job, stopped func() error, send func(*job), fail func(*ChunkError))
+
+	// load is called by a worker to read the ciphertext of j, if chunks
+	// didn't.
+	load(j *job) error
+}
+
+// readerSource reads the payload sequentially from an io.Reader.
+type readerSource struct {
+	src io.Reader
+}
+
+func (s *readerSource) chunks(reJob chan *job, stopped func() error, send func(*job), fail func(*ChunkError)) {
+	var nonce [chacha20poly1305.NonceSize]byte
+	var index int64
+
+	// A full chunk is held back until the next read tells whether it is
+	// the last one.
+	var pending *job
+
+	for stopped() == nil {
+		j := <-reJob
+		j.index = index
+		j.nonce = nonce
+		j.last = false
+
+		n, err := io.ReadFull(s.src, j.in[:encChunkSize])
+		j.in = j.in[:n]
+
+		switch {
+		case err == io.EOF:
+			if pending == nil {
+				// There is always at least one chunk, even for an empty
+				// plaintext.
+				fail(newChunkError(Truncated, index))
+
+				return
+			}
+
+			// The pending chunk is a full-length final chunk.
+			pending.last = true
+			send(pending)
+
+			return
+
+		case err == io.ErrUnexpectedEOF:
+			if pending != nil {
+				send(pending)
+			}
+
+			switch {
+			case n < chacha20poly1305.Overhead:
+				fail(newChunkError(Truncated, index))
+			case index > 0 && n == chacha20poly1305.Overhead:
+				// The last chunk can be short, but not empty unless it's the
+				// first and only chunk.
+				fail(newChunkError(EmptyLastChunk, index))
+			default:
+				j.last = true
+				send(j)
+			}
+
+			return
+
+		case err != nil:
+			if pending != nil {
+				send(pending)
+			}
+
+			e := newChunkError(ReadFailed, index)
+			e.CiphertextOffset += int64(n)
+			e.Err = err
+			fail(e)
+
+			return
+		}
+
+		if pending != nil {
+			send(pending)
+		}
+		pending = j
+
+		index++
+		incNonce(&nonce)
+	}
+}
+
+func (s *readerSource) load(j *job) error {
+	return nil
+}
+
+// readerAtSource reads the payload with concurrent ReadAt calls from the
+// workers. As the size is known up front, chunks only has to schedule them.
+type readerAtSource struct {
+	src  io.ReaderAt
+	size int64
+}
+
+func (s *readerAtSource) chunks(reJob chan *job, stopped func() error, send func(*job), fail func(*ChunkError)) {
+	scheduleChunks(s.size, reJob, stopped, func(j *job, n int64) {
+		j.in = j.in[:n]
+		send(j)
+	}, fail)
+}
+
+// scheduleChunks passes every chunk of a payload of the given size to send
+// with the size of its ciphertext, performing the same checks as readerSource.
+func scheduleChunks(size int64, reJob chan *job, stopped func() error, send func(*job, int64), fail func(*ChunkError)) {
+	count := (size + encChunkSize - 1) / encChunkSize
+	lastSize := size - (count-1)*encChunkSize
+
+	var nonce [chacha20poly1305.NonceSize]byte
+
+	for index := int64(0); index < count && stopped() == nil; index++ {
+		j := <-reJob
+		j.index = index
+		j.nonce = nonce
+		j.last = index == count-1
+
+		n := int64(encChunkSize)
+		if j.last {
+			switch {
+			case lastSize < chacha20poly1305.Overhead:
+				fail(newChunkError(Truncated, index))
+
+				return
+			case index > 0 && lastSize == chacha20poly1305.Overhead:
+				// The last chunk can be short, but not empty unless it's the
+				// first and only chunk.
+				fail(newChunkError(EmptyLastChunk, index))
+
+				return
+			}
+
+			n = lastSize
+		}
+
+		send(j, n)
+
+		incNonce(&nonce)
+	}
+
+	if count == 0 {
+		// There is always at least one chunk, even for an empty plaintext.
+		fail(newChunkError(Truncated, 0))
+	}
+}
+
+func (s *readerAtSource) load(j *job) error {
+	offset := j.index * encChunkSize
+
+	n, err := s.src.ReadAt(j.in, offset)
+	if n == len(j.in) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	e := newChunkError(ReadFailed, j.index)
+	e.CiphertextOffset += int64(n)
+	e.Err = err
+
+	return e
+}
+
+// bytesSource decrypts the payload in place, for example from a memory mapped
+// file, without copying it into the job buffers.
+type bytesSource struct {
+	buf []byte
+}
+
+func (s *bytesSource) chunks(reJob chan *job, stopped func() error, send func(*job), fail func(*ChunkError)) {
+	scheduleChunks(int64(len(s.buf)), reJob, stopped, func(j *job, n int64) {
+		offset := j.index * encChunkSize
+		j.in = s.buf[offset : offset+n : offset+n]
+		send(j)
+	}, fail)
+}
+
+func (s *bytesSource) load(j *job) error {
+	return nil
+}
+
+// delimitedSource reads a payload followed by more data starting with next,
+// such as another age file, from a bufio.Reader. As the size of the payload
+// isn't known, the final chunk is found by authenticating the candidates in
+// front of next, and in front of the end of the input.
+type delimitedSource struct {
+	src  *bufio.Reader
+	next []byte
+	a    cipher.AEAD
+	buf  []byte
+}
+
+// isFinal reports whether chunk authenticates as a final chunk with nonce.
+func (s *delimitedSource) isFinal(chunk []byte, nonce [chacha20poly1305.NonceSize]byte) bool {
+	setLastChunkFlag(&nonce)
+
+	_, err := s.a.Open(s.buf[:0], nonce[:], chunk, nil)
+
+	return err == nil
+}
+
+// finalSize returns the size of the final chunk at the start of peek, or -1
+// if it's not the final chunk. atEOF tells whether the input ends after peek.
+func (s *delimitedSource) finalSize(peek []byte, atEOF bool, nonce [chacha20poly1305.NonceSize]byte) int {
+	limit := len(peek)
+	if limit > encChunkSize {
+		limit = encChunkSize
+	}
+
+	for p := chacha20poly1305.Overhead; p <= limit; p++ {
+		i := bytes.Index(peek[p:], s.next)
+		if i < 0 {
+			break
+		}
+
+		p += i
+		if p > limit {
+			break
+		}
+		if s.isFinal(peek[:p], nonce) {
+			return p
+		}
+	}
+
+	if atEOF && len(peek) <= encChunkSize && len(peek) >= chacha20poly1305.Overhead && s.isFinal(peek, nonce) {
+		return len(peek)
+	}
+
+	return -1
+}
+
+func (s *delimitedSource) chunks(reJob chan *job, stopped func() error, send func(*job), fail func(*ChunkError)) {
+	var nonce [chacha20poly1305.NonceSize]byte
+	var index int64
+
+	for stopped() == nil {
+		peek, err := s.src.Peek(encChunkSize + len(s.next))
+		atEOF := err == io.EOF
+
+		n := s.finalSize(peek, atEOF, nonce)
+		last := n >= 0
+
+		switch {
+		case err != nil && !atEOF && !last && len(peek) < encChunkSize:
+			// The data read so far isn't enough to tell where the chunk
+			// ends.
+			e := newChunkError(ReadFailed, index)
+			e.CiphertextOffset += int64(len(peek))
+			e.Err = err
+			fail(e)
+
+			return
+		case last && index > 0 && n == chacha20poly1305.Overhead:
+			// The last chunk can be short, but not empty unless it's the
+			// first and only chunk.
+			fail(newChunkError(EmptyLastChunk, index))
+
+			return
+		case last:
+		case len(peek) >= encChunkSize:
+			n = encChunkSize
+		case len(peek) < chacha20poly1305.Overhead || index > 0 && len(peek) == chacha20poly1305.Overhead:
+			fail(newChunkError(Truncated, index))
+
+			return
+		default:
+			// A short chunk at the end of the input which doesn't
+			// authenticate, let the worker report why.
+			n = len(peek)
+			last = true
+		}
+
+		j := <-reJob
+		j.index = index
+		j.nonce = nonce
+		j.last = last
+		j.in = j.in[:n]
+		copy(j.in, peek)
+
+		_, _ = s.src.Discard(n)
+
+		send(j)
+
+		if last {
+			return
+		}
+
+		index++
+		incNonce(&nonce)
+	}
+}
+
+func (s *delimitedSource) load(j *job) error {
+	return nil
+}